@@ -11,7 +11,10 @@ import (
 	"strings"
 )
 
+var dumpWarnMixedLineEndings bool
+
 func init() {
+	dumpCmd.Flags().BoolVar(&dumpWarnMixedLineEndings, "warn-mixed-eol", false, "Warn about files mixing LF and CRLF line endings")
 	rootCmd.AddCommand(dumpCmd)
 }
 
@@ -24,6 +27,7 @@ var dumpCmd = &cobra.Command{
 		if strings.HasSuffix(p, "/...") {
 			p = strings.TrimSuffix(p, "/...")
 			c := 0
+			failed := 0
 			err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
@@ -33,16 +37,26 @@ var dumpCmd = &cobra.Command{
 					return nil
 				}
 
-				if info.Name() == "Makefile" || strings.HasSuffix(info.Name(), ".mk") {
+				if isMakefile(info.Name()) {
 					fmt.Println(path)
 					c++
-					return parse(path, false)
+					// Keep going, a single bad file should not stop the scan
+					if err := parse(path, false); err != nil {
+						fmt.Println(err)
+						failed++
+					}
 				}
 
 				return nil
 			})
 			fmt.Printf("Found %v files\n", c)
-			return err
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("failed to parse %v of %v files", failed, c)
+			}
+			return nil
 		} else {
 			return parse(p, true)
 		}
@@ -52,10 +66,11 @@ var dumpCmd = &cobra.Command{
 func parse(path string, print bool) error {
 	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer f.Close()
 
-	tokens, err := lexer.Tokenize(f)
+	tokens, err := lexer.TokenizeFilename(path, f)
 	if err != nil {
 		return err
 	}
@@ -66,19 +81,28 @@ func parse(path string, print bool) error {
 	}
 
 	p := parser.NewParserTokens(tokens)
+	p.WarnMixedLineEndings = dumpWarnMixedLineEndings
 
-	node, err := p.Parse()
+	node, diags := p.ParseRecover()
 	if print {
 		repr.Println(node)
 		fmt.Println()
 	}
 
-	if err != nil {
-		return err
+	for _, d := range diags {
+		fmt.Println(d)
+	}
+
+	if diags.HasErrors() {
+		return fmt.Errorf("%v: failed to parse", path)
 	}
 	return nil
 }
 
+func isMakefile(name string) bool {
+	return name == "Makefile" || strings.HasSuffix(name, ".mk")
+}
+
 func PrintTokens(tokens []lexer.Token) {
 	for _, t := range tokens {
 		fmt.Println(t.StringAlign())
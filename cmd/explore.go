@@ -1,15 +1,26 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/alecthomas/repr"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"mxplrr/parser"
 	"mxplrr/runner"
 	"path/filepath"
+	"sort"
+)
+
+var (
+	exploreNoBuiltinRules     bool
+	exploreNoBuiltinVariables bool
+	exploreExpand             bool
 )
 
 func init() {
+	explorerCmd.Flags().BoolVarP(&exploreNoBuiltinRules, "no-builtin-rules", "r", false, "Disable the built-in implicit rules")
+	explorerCmd.Flags().BoolVarP(&exploreNoBuiltinVariables, "no-builtin-variables", "R", false, "Disable the built-in variables and implicit rules")
+	explorerCmd.Flags().BoolVar(&exploreExpand, "expand", false, "Print the recipe commands as make would run them")
 	rootCmd.AddCommand(explorerCmd)
 }
 
@@ -31,18 +42,56 @@ var explorerCmd = &cobra.Command{
 
 		r := runner.New()
 		r.RootDir = filepath.Dir(filePath)
+		r.NoBuiltinRules = exploreNoBuiltinRules
+		r.NoBuiltinVariables = exploreNoBuiltinVariables
 
 		err = r.Include(n)
 		if err != nil {
 			return err
 		}
 
-		target, ok := r.Targets[targetName]
+		target, ok, err := r.Target(targetName)
+		if err != nil {
+			return err
+		}
 		if !ok {
 			return errors.Errorf("unknown target")
 		}
 
-		repr.Println(target)
+		if exploreExpand {
+			cmds, err := r.ExpandRecipe(targetName)
+			if err != nil {
+				return err
+			}
+
+			for _, cmd := range cmds {
+				fmt.Println(cmd.Text)
+			}
+		} else {
+			repr.Println(target)
+		}
+
+		vars, err := r.VarsFor(targetName)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value, err := r.RunWithVars(vars, func() (string, error) {
+				return vars[name].Get(r)
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%v = %v\n", name, value)
+		}
 
 		return nil
 	},
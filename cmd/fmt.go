@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"mxplrr/parser"
+	"mxplrr/printer"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var (
+	fmtList  bool
+	fmtWrite bool
+	fmtDiff  bool
+)
+
+func init() {
+	fmtCmd.Flags().BoolVarP(&fmtList, "list", "l", false, "List files whose formatting differs")
+	fmtCmd.Flags().BoolVarP(&fmtWrite, "write", "w", false, "Write result to the source file instead of stdout")
+	fmtCmd.Flags().BoolVarP(&fmtDiff, "diff", "d", false, "Display diffs instead of rewriting files")
+
+	rootCmd.AddCommand(fmtCmd)
+}
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt [path...]",
+	Short: "Format Makefiles",
+	Long:  "Format Makefiles. Directories are walked for Makefiles, without arguments stdin is formatted.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			if fmtWrite {
+				return fmt.Errorf("cannot use -w with stdin")
+			}
+
+			src, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+
+			return formatSource("<standard input>", src)
+		}
+
+		failed := false
+		for _, arg := range args {
+			err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if info.IsDir() || (path != arg && !isMakefile(info.Name())) {
+					return nil
+				}
+
+				if err := formatFile(path, info); err != nil {
+					log.Error(err)
+					failed = true
+				}
+
+				return nil
+			})
+			if err != nil {
+				log.Error(err)
+				failed = true
+			}
+		}
+
+		if failed {
+			return fmt.Errorf("some files could not be formatted")
+		}
+
+		return nil
+	},
+}
+
+func formatFile(path string, info os.FileInfo) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	res, err := format(path, src)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(src, res) {
+		if fmtList {
+			fmt.Println(path)
+		}
+
+		if fmtWrite {
+			err := ioutil.WriteFile(path, res, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+		}
+
+		if fmtDiff {
+			err := printDiff(path, src, res)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !fmtList && !fmtWrite && !fmtDiff {
+		_, err = os.Stdout.Write(res)
+	}
+
+	return err
+}
+
+func formatSource(path string, src []byte) error {
+	res, err := format(path, src)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(src, res) {
+		if fmtList {
+			fmt.Println(path)
+		}
+
+		if fmtDiff {
+			return printDiff(path, src, res)
+		}
+	}
+
+	if !fmtList && !fmtDiff {
+		_, err = os.Stdout.Write(res)
+	}
+
+	return err
+}
+
+func format(path string, src []byte) ([]byte, error) {
+	f, err := parser.ParseSource(path, src)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return printer.Format(f)
+}
+
+func printDiff(path string, a, b []byte) error {
+	dir, err := ioutil.TempDir("", "mxplrr-fmt")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fa := filepath.Join(dir, "a")
+	fb := filepath.Join(dir, "b")
+	if err := ioutil.WriteFile(fa, a, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fb, b, 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("diff", "-u", "--label", "a/"+path, "--label", "b/"+path, fa, fb)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// diff exits with 1 when the files differ
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,44 @@
+// Package fuzzcorpus seeds the fuzz tests with the strings found in the tests of the repository.
+// Fuzzing needs Go 1.18 or later, so the fuzz tests using it are only built by these toolchains,
+// while this package builds with the Go version of go.mod.
+// Being internal, it is imported by the path of the module rather than through the mxplrr replacement.
+package fuzzcorpus
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+)
+
+// F is the part of testing.F used to add the corpus
+type F interface {
+	Add(args ...interface{})
+	Fatal(args ...interface{})
+}
+
+// Add seeds f with the string literals of the tests of the repository, from the directory of a package
+func Add(f F) {
+	files, err := filepath.Glob("../*/*_test.go")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	for _, file := range files {
+		af, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		ast.Inspect(af, func(n ast.Node) bool {
+			if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if s, err := strconv.Unquote(lit.Value); err == nil {
+					f.Add(s)
+				}
+			}
+			return true
+		})
+	}
+}
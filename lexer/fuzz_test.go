@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+// Fuzzing needs Go 1.18 or later, older toolchains skip these tests with a message from fuzz_skip_test.go
+
+package lexer
+
+import (
+	"github.com/raphaelvigee/mxplrr/internal/fuzzcorpus"
+	"strings"
+	"testing"
+)
+
+func FuzzTokenize(f *testing.F) {
+	fuzzcorpus.Add(f)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		_, _ = Tokenize(strings.NewReader(s))
+	})
+}
@@ -1,91 +1,336 @@
 package lexer
 
 import (
+	"bytes"
 	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/alecthomas/participle/v2/lexer/stateful"
 	"io"
-	"strings"
+	"io/ioutil"
 )
 
 var _def *stateful.Definition
 
+// symbols are the token types of _def, along with Keyword
+var symbols map[string]rune
+
 func init() {
-	ExpStart := stateful.Rule{`ExpStart`, `\$[({]`, stateful.Push("Exp")}
-	ExpVar := stateful.Rule{`ExpVar`, `\$[\d]+|\$[\w]`, nil}
-	Char := stateful.Rule{`Char`, `.|\n`, nil}
-	AssignOp := stateful.Rule{`AssignOp`, `::=|:=|\?=|!=|\+=|=`, nil}
-	KeywordPattern := strings.Join([]string{
-		"endif",
-		"ifeq",
-		"ifneq",
-		"ifdef",
-		"ifndef",
-		"include",
-		"define",
-		"endef",
-	}, "|")
+	ExpStart := stateful.Rule{Name: `ExpStart`, Pattern: `\$\(`, Action: stateful.Push("Exp")}
+	BraceExpStart := stateful.Rule{Name: `BraceExpStart`, Pattern: `\$\{`, Action: stateful.Push("BraceExp")}
+	LParen := stateful.Rule{Name: `LParen`, Pattern: `\(`, Action: stateful.Push("Paren")}
+	LBrace := stateful.Rule{Name: `LBrace`, Pattern: `\{`, Action: stateful.Push("Brace")}
+	GroupChar := stateful.Rule{Name: `GroupChar`, Pattern: `[^\r\n]`}
+	ExpVar := stateful.Rule{Name: `ExpVar`, Pattern: `\$[\d]+|\$[\w@<^+?*|%]`}
+	Char := stateful.Rule{Name: `Char`, Pattern: `\r?\n|.`}
+	AssignOp := stateful.Rule{Name: `AssignOp`, Pattern: `::=|:=|\?=|!=|\+=|=`}
 
 	_def = stateful.Must(stateful.Rules{
 		"Base": {
-			{"line_continuation", `\\\n\s*`, nil},
-			{`Comment`, `#[^\n]*`, nil},
-			{`Escaped`, `\\.|[$]{2}`, nil},
+			{Name: `Continuation`, Pattern: `\\\r?\n`},
+			{Name: `Comment`, Pattern: `#(?:\\\r?\n|[^\r\n]|\r[^\n])*`},
+			{Name: `Escaped`, Pattern: `\\[^$]|[$]{2}`},
 		},
 		"Common": {
 			stateful.Include("Base"),
 		},
+		// Like make, only the parentheses are balanced in $(...), and only the braces in ${...}
 		"Exp": {
 			stateful.Include("Base"),
-			{`ExpEnd`, `[)}]`, stateful.Pop()},
-			{`ExpStr`, `'[^']*'|"[^"]*"`, nil},
+			{Name: `ExpEnd`, Pattern: `\)`, Action: stateful.Pop()},
+			LParen,
 			ExpVar,
 			ExpStart,
+			BraceExpStart,
 			Char,
 		},
-		"Keyword": {
-			stateful.Include("Common"),
-			{`Nl`, `\n`, stateful.Push("Root")},
-			stateful.Include("Root"),
+		"BraceExp": {
+			stateful.Include("Base"),
+			{Name: `BraceExpEnd`, Pattern: `\}`, Action: stateful.Pop()},
+			LBrace,
+			ExpVar,
+			ExpStart,
+			BraceExpStart,
+			Char,
+		},
+		// Text between literal parentheses or braces, where commas do not separate arguments
+		"Paren": {
+			stateful.Include("Base"),
+			{Name: `RParen`, Pattern: `\)`, Action: stateful.Pop()},
+			LParen,
+			ExpVar,
+			ExpStart,
+			BraceExpStart,
+			GroupChar,
+			Char,
+		},
+		"Brace": {
+			stateful.Include("Base"),
+			{Name: `RBrace`, Pattern: `\}`, Action: stateful.Pop()},
+			LBrace,
+			ExpVar,
+			ExpStart,
+			BraceExpStart,
+			GroupChar,
+			Char,
 		},
 		"Root": {
 			stateful.Include("Common"),
 			AssignOp,
-			{`Colon`, `:`, nil},
-			{`Nl`, `\n`, nil},
-			{`Tab`, `\t`, nil},
+			{Name: `DoubleColon`, Pattern: `::`},
+			{Name: `GroupedColon`, Pattern: `&:`},
+			{Name: `Colon`, Pattern: `:`},
+			{Name: `Nl`, Pattern: `\r?\n`},
+			{Name: `Tab`, Pattern: `\t`},
 			ExpVar,
 			ExpStart,
-			{`Keyword`, KeywordPattern, stateful.Push("Keyword")},
+			BraceExpStart,
 			Char,
 		},
 	})
+
+	// Keyword tokens are not matched by a rule, as directives depend on their place in the line,
+	// promoteKeywords makes them from Char tokens
+	symbols = map[string]rune{}
+	keyword := rune(0)
+	for name, t := range _def.Symbols() {
+		symbols[name] = t
+		if t <= keyword {
+			keyword = t - 1
+		}
+	}
+	symbols["Keyword"] = keyword
 }
 
 func Tokenize(r io.Reader) ([]Token, error) {
-	lex, err := Def().Lex("", r)
+	return TokenizeFilename("", r)
+}
+
+// TokenizeFilename is like Tokenize, but records filename in the position of the tokens.
+// Like make, a variable reference is closed by the end of the line: the lexer then emits
+// the missing closing tokens, with an empty value, and goes on with the next line.
+func TokenizeFilename(filename string, r io.Reader) ([]Token, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	toks := make([]Token, 0)
+	base := lexer.Position{Filename: filename, Line: 1, Column: 1}
+	for {
+		lineToks, err := lex(bytes.NewReader(src[base.Offset:]), base)
+		if err != nil {
+			return nil, err
+		}
+
+		i, closing := unterminated(lineToks)
+		if i < 0 {
+			toks = append(toks, lineToks...)
+			break
+		}
+
+		toks = append(toks, lineToks[:i]...)
+		toks = append(toks, closing...)
+		base = lineToks[i].Pos
+	}
+
+	return promoteKeywords(toks), nil
+}
+
+// TokenizeExpr is like Tokenize, but for the value of a variable, in which a variable reference may span lines
+func TokenizeExpr(r io.Reader) ([]Token, error) {
+	toks, err := lex(r, lexer.Position{Line: 1, Column: 1})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	toks, err := lexer.ConsumeAll(lex)
+	return promoteKeywords(toks), nil
+}
+
+// lex tokenizes the content of r, which starts at the position base
+func lex(r io.Reader, base lexer.Position) ([]Token, error) {
+	l, err := Def().Lex(base.Filename, r)
+	if err != nil {
+		return nil, err
+	}
+
+	toks, err := lexer.ConsumeAll(l)
 	if err != nil {
 		return nil, err
 	}
 
 	mytoks := make([]Token, len(toks))
 	for i, t := range toks {
+		if t.Pos.Line == 1 {
+			t.Pos.Column += base.Column - 1
+		}
+		t.Pos.Line += base.Line - 1
+		t.Pos.Offset += base.Offset
+
 		mytoks[i] = Token(t)
 	}
 
 	return mytoks, nil
 }
 
+// unterminated returns the index of the first newline inside a variable reference,
+// along with the tokens closing the references and the parentheses left open there, or -1
+func unterminated(toks []Token) (int, []Token) {
+	closers := map[rune]string{
+		Symbol("ExpStart"):      "ExpEnd",
+		Symbol("BraceExpStart"): "BraceExpEnd",
+		Symbol("LParen"):        "RParen",
+		Symbol("LBrace"):        "RBrace",
+	}
+	char := Symbol("Char")
+
+	open := make([]string, 0)
+	for i, t := range toks {
+		if closer, ok := closers[t.Type]; ok {
+			open = append(open, closer)
+			continue
+		}
+
+		if len(open) == 0 {
+			continue
+		}
+
+		if SymbolName(t.Type) == open[len(open)-1] {
+			open = open[:len(open)-1]
+			continue
+		}
+
+		if t.Type == char && (t.Value == "\n" || t.Value == "\r\n") {
+			closing := make([]Token, 0, len(open))
+			for j := len(open) - 1; j >= 0; j-- {
+				closing = append(closing, Token{Type: Symbol(open[j]), Pos: t.Pos})
+			}
+
+			return i, closing
+		}
+	}
+
+	return -1, nil
+}
+
+var keywords = []string{
+	"endif",
+	"else",
+	"ifeq",
+	"ifneq",
+	"ifdef",
+	"ifndef",
+	"include",
+	"sinclude",
+	"define",
+	"endef",
+}
+
+// promoteKeywords merges the Char tokens spelling a directive into a Keyword token.
+// Like make, a directive only counts at the start of a line, after optional blanks,
+// `-` for include, `override` or `export` for define, and `else` for conditionals,
+// and when followed by a blank or the end of the line.
+func promoteKeywords(toks []Token) []Token {
+	char, tab, nl, comment, keyword := Symbol("Char"), Symbol("Tab"), Symbol("Nl"), Symbol("Comment"), Symbol("Keyword")
+	continuation := Symbol("Continuation")
+
+	isBlank := func(i int) bool {
+		return i < len(toks) && (toks[i].Type == tab || toks[i].Type == continuation || toks[i].Type == char && toks[i].Value == " ")
+	}
+	skipBlanks := func(i int) int {
+		for isBlank(i) {
+			i++
+		}
+		return i
+	}
+	// word returns the lowercase word starting at i along with the index of the token following it,
+	// the word being empty if it is not followed by a blank or the end of the line
+	word := func(i int) (string, int) {
+		w := ""
+		for ; i < len(toks) && toks[i].Type == char && len(toks[i].Value) == 1 && toks[i].Value[0] >= 'a' && toks[i].Value[0] <= 'z'; i++ {
+			w += toks[i].Value
+		}
+
+		if i < len(toks) && !isBlank(i) && toks[i].Type != nl && toks[i].Type != comment && toks[i].Type != EOF {
+			return "", i
+		}
+
+		return w, i
+	}
+
+	out := make([]Token, 0, len(toks))
+	promote := func(i int, w string) {
+		out = append(out, Token{Type: keyword, Value: w, Pos: toks[i].Pos})
+	}
+
+	i := 0
+	for i < len(toks) {
+		// Start of a line
+		start := skipBlanks(i)
+		out = append(out, toks[i:start]...)
+		i = start
+
+		allowed := func(w string) bool {
+			for _, k := range keywords {
+				if w == k {
+					return true
+				}
+			}
+			return false
+		}
+		if i < len(toks) && toks[i].Type == char && toks[i].Value == "-" {
+			out = append(out, toks[i])
+			i++
+			allowed = func(w string) bool { return w == "include" }
+		} else {
+			for {
+				w, end := word(i)
+				if w != "override" && w != "export" {
+					break
+				}
+
+				out = append(out, toks[i:skipBlanks(end)]...)
+				i = skipBlanks(end)
+				allowed = func(w string) bool { return w == "define" }
+			}
+		}
+
+		if w, end := word(i); w != "" && allowed(w) {
+			promote(i, w)
+			i = end
+
+			if w == "else" {
+				start := skipBlanks(i)
+				out = append(out, toks[i:start]...)
+				i = start
+
+				switch w, end := word(i); w {
+				case "ifeq", "ifneq", "ifdef", "ifndef":
+					promote(i, w)
+					i = end
+				}
+			}
+		}
+
+		// Rest of the line
+		for i < len(toks) {
+			t := toks[i]
+			out = append(out, t)
+			i++
+
+			if t.Type == nl {
+				break
+			}
+		}
+	}
+
+	return out
+}
+
 func Def() *stateful.Definition {
 	return _def
 }
 
 func Symbols() map[string]rune {
-	return Def().Symbols()
+	return symbols
 }
 
 func Symbol(name string) rune {
@@ -3,10 +3,14 @@ package lexer
 import (
 	"fmt"
 	plexer "github.com/alecthomas/participle/v2/lexer"
+	"strings"
+	"unicode/utf8"
 )
 
 type Token plexer.Token
 
+type Position = plexer.Position
+
 var EOF = plexer.EOF
 
 var NilToken = Token{Type: EOF}
@@ -18,3 +22,19 @@ func (t Token) StringAlign() string {
 func (t Token) String() string {
 	return fmt.Sprintf("%v %v %q", SymbolName(t.Type), t.Pos, t.Value)
 }
+
+// End returns the position right after the token
+func (t Token) End() Position {
+	pos := t.Pos
+	pos.Offset += len(t.Value)
+
+	lines := strings.Count(t.Value, "\n")
+	pos.Line += lines
+	if lines == 0 {
+		pos.Column += utf8.RuneCountInString(t.Value)
+	} else {
+		pos.Column = utf8.RuneCountInString(t.Value[strings.LastIndex(t.Value, "\n"):])
+	}
+
+	return pos
+}
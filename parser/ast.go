@@ -1,8 +1,27 @@
 package parser
 
+import "mxplrr/lexer"
+
 type Node interface {
 	SetComments(comments []string)
 	Comments() []string
+	SetPos(start, end lexer.Position)
+	Pos() Span
+}
+
+// Span is the source range a node was parsed from
+type Span struct {
+	Start lexer.Position
+	End   lexer.Position
+}
+
+func (s *Span) SetPos(start, end lexer.Position) {
+	s.Start = start
+	s.End = end
+}
+
+func (s Span) Pos() Span {
+	return s
 }
 
 type Base []string
@@ -17,49 +36,90 @@ func (b Base) Comments() []string {
 
 type File struct {
 	Base
-	Path  string
-	Nodes Node
+	Span
+	Path   string
+	Nodes  Node
+	Source []byte
 }
 
 type Target struct {
 	Base
-	Name   Node
-	Deps   Node
-	Recipe []Node
+	Span
+	Name      Node
+	Deps      Node
+	OrderOnly Node
+	Recipe    []Node
+	// DoubleColon is set for `target:: deps` rules, which are independent of the other rules of the target
+	DoubleColon bool
+	// Grouped is set for `a b &: deps` rules, whose recipe produces all the targets at once
+	Grouped bool
+}
+
+// RecipeLine is a command of the recipe of a rule
+type RecipeLine struct {
+	Base
+	Span
+	// Silent is set by the `@` prefix, the command is not echoed
+	Silent bool
+	// IgnoreErrors is set by the `-` prefix, a failure of the command does not stop make
+	IgnoreErrors bool
+	// Always is set by the `+` prefix, the command runs even with `make -n`
+	Always bool
+	Cmd    Node
+}
+
+// TargetVar is a target-specific or pattern-specific variable assignment, like `target: VAR = value`
+type TargetVar struct {
+	Base
+	Span
+	Targets  Node
+	Override bool
+	Export   bool
+	Private  bool
+	Var      *Var
 }
 
 type StaticPatternTarget struct {
 	Base
-	Names   Node
-	Targets Node
-	Prereqs Node
-	Recipe  []Node
+	Span
+	Names     Node
+	Targets   Node
+	Prereqs   Node
+	OrderOnly Node
+	Recipe    []Node
 }
 
 type Raw struct {
 	Base
+	Span
 	Text string
 }
 
 type Expr struct {
 	Base
+	Span
 	Parts []Node
 }
 
 type Exp struct {
 	Base
+	Span
 	Parts []Node
 }
 
 type Var struct {
 	Base
+	Span
 	Name  Node
 	Op    string
 	Value string
+	// Body is the parsed Value, only set when Parser.ParseVarBody is enabled
+	Body Node
 }
 
 type PatSubst struct {
 	Base
+	Span
 	Name    Node
 	Pattern Node
 	Subst   Node
@@ -67,37 +127,49 @@ type PatSubst struct {
 
 type Include struct {
 	Base
+	Span
 	Path Node
 }
 
 type IfEq struct {
 	Base
+	Span
 	Expected bool
 	Left     Node
 	Right    Node
 	Body     []Node
+	Else     []Node
 }
 
 type IfDef struct {
 	Base
+	Span
 	Expected bool
 	Ident    string
 	Body     []Node
+	Else     []Node
 }
 
 type Comment struct {
 	Base
+	Span
 	Text string
 }
 
 type Define struct {
 	Base
+	Span
 	Name string
-	Body string
+	// Op is the assignment operator following the name, empty when omitted
+	Op       string
+	Body     string
+	Override bool
+	Export   bool
 }
 
 type Modifier struct {
 	Base
+	Span
 	Modifier string
 	Node     Node
 }
@@ -105,9 +177,26 @@ type Modifier struct {
 type Nodes []Node
 
 func (b Nodes) SetComments(comments []string) {
+	if len(b) == 0 {
+		return
+	}
+
 	b[0].SetComments(comments)
 }
 
 func (b Nodes) Comments() []string {
 	return nil
 }
+
+func (b Nodes) SetPos(lexer.Position, lexer.Position) {}
+
+func (b Nodes) Pos() Span {
+	if len(b) == 0 {
+		return Span{}
+	}
+
+	return Span{
+		Start: b[0].Pos().Start,
+		End:   b[len(b)-1].Pos().End,
+	}
+}
@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"mxplrr/lexer"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Diagnostic is a problem found while parsing
+type Diagnostic struct {
+	Pos      lexer.Position
+	Severity Severity
+	Message  string
+	// Trace is the stack of parser rules that led to the problem
+	Trace []string
+}
+
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%v: %v: ", d.Pos, d.Severity)
+	if len(d.Trace) > 0 {
+		s += "[" + strings.Join(d.Trace, " > ") + "]: "
+	}
+
+	return s + d.Message
+}
+
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newDiagnostic(err error, fallback lexer.Position) Diagnostic {
+	d := Diagnostic{
+		Pos:      fallback,
+		Severity: SeverityError,
+		Message:  err.Error(),
+	}
+
+	var te *traceErr
+	if errors.As(err, &te) {
+		d.Trace = te.trace
+		d.Message = te.err.Error()
+		if te.pos.Line > 0 {
+			d.Pos = te.pos
+		}
+	}
+
+	return d
+}
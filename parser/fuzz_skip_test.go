@@ -0,0 +1,10 @@
+//go:build !go1.18
+// +build !go1.18
+
+package parser
+
+import "testing"
+
+func TestFuzz(t *testing.T) {
+	t.Skip("the fuzz tests need Go 1.18 or later")
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+// Fuzzing needs Go 1.18 or later, older toolchains skip these tests with a message from fuzz_skip_test.go
+
+package parser
+
+import (
+	"github.com/raphaelvigee/mxplrr/internal/fuzzcorpus"
+	"strings"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	fuzzcorpus.Add(f)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := NewParserString(s)
+		if err != nil {
+			return
+		}
+
+		_, _ = p.Parse()
+	})
+}
+
+func FuzzParseRecover(f *testing.F) {
+	fuzzcorpus.Add(f)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := NewParserString(s)
+		if err != nil {
+			return
+		}
+
+		_, _ = p.ParseRecover()
+	})
+}
+
+func FuzzParseExpr(f *testing.F) {
+	fuzzcorpus.Add(f)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := NewParserString(s)
+		if err != nil {
+			return
+		}
+
+		_, _ = p.ParseExpr()
+	})
+}
+
+func FuzzParseVarBody(f *testing.F) {
+	fuzzcorpus.Add(f)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := NewParserFilename("Makefile", strings.NewReader(s))
+		if err != nil {
+			return
+		}
+		p.ParseVarBody = true
+
+		_, _ = p.Parse()
+	})
+}
@@ -1,21 +1,37 @@
 package parser
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mxplrr/lexer"
-	"os"
 	"strings"
+	"unicode/utf8"
 )
 
-var NlMatcher = lexer.NewMultiMatcher(lexer.NewMatcher("Char", "\n"), lexer.NewMatcher("Nl"))
+var NlMatcher = lexer.NewMultiMatcher(lexer.NewMatcher("Char", "\n", "\r\n"), lexer.NewMatcher("Nl"))
+
+var blankMatcher = lexer.NewMultiMatcher(lexer.NewMatcher("Char", " "), lexer.NewMatcher("Tab"), continuationMatcher)
+
+var continuationMatcher = lexer.NewMatcher("Continuation")
+
+var expStartMatcher = lexer.NewMultiMatcher(lexer.NewMatcher("ExpStart"), lexer.NewMatcher("BraceExpStart"))
+
+var expEndMatcher = lexer.NewMultiMatcher(lexer.NewMatcher("ExpEnd"), lexer.NewMatcher("BraceExpEnd"))
 
 func isEOF(t lexer.Token) bool {
 	return lexer.NewMatcher("EOF").Is(t)
 }
 
 func NewParser(r io.Reader) (*Parser, error) {
-	toks, err := lexer.Tokenize(r)
+	return NewParserFilename("", r)
+}
+
+// NewParserFilename is like NewParser, but records filename in the position of the nodes
+func NewParserFilename(filename string, r io.Reader) (*Parser, error) {
+	toks, err := lexer.TokenizeFilename(filename, r)
 	if err != nil {
 		return nil, err
 	}
@@ -27,14 +43,28 @@ func NewParserString(s string) (*Parser, error) {
 	return NewParser(strings.NewReader(s))
 }
 
+// NewParserExprString is like NewParserString, but for the value of a variable, in which a variable reference may span lines
+func NewParserExprString(s string) (*Parser, error) {
+	toks, err := lexer.TokenizeExpr(strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewParserTokens(toks), nil
+}
+
 func ParseFile(filename string) (*File, error) {
-	f, err := os.Open(filename)
+	src, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	p, err := NewParser(f)
+	return ParseSource(filename, src)
+}
+
+// ParseSource parses src, which is used as the content of filename
+func ParseSource(filename string, src []byte) (*File, error) {
+	p, err := NewParserFilename(filename, bytes.NewReader(src))
 	if err != nil {
 		return nil, err
 	}
@@ -44,10 +74,36 @@ func ParseFile(filename string) (*File, error) {
 		return nil, err
 	}
 
-	return &File{
-		Path:  filename,
-		Nodes: n,
-	}, nil
+	return p.file(filename, src, n), nil
+}
+
+// ParseFileRecover is like ParseFile, but keeps going after errors,
+// returning the partial file along with the problems found
+func ParseFileRecover(filename string) (*File, Diagnostics, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := NewParserFilename(filename, bytes.NewReader(src))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n, diags := p.ParseRecover()
+
+	return p.file(filename, src, n), diags, nil
+}
+
+func (p *Parser) file(filename string, src []byte, n Node) *File {
+	file := &File{
+		Path:   filename,
+		Nodes:  n,
+		Source: src,
+	}
+	file.SetPos(p.tokenAt(0).Pos, p.tokenAt(len(p.tokens)).Pos)
+
+	return file
 }
 
 func NewParserTokens(tokens []lexer.Token) *Parser {
@@ -57,10 +113,21 @@ func NewParserTokens(tokens []lexer.Token) *Parser {
 }
 
 type Parser struct {
+	// ParseVarBody makes the parser fill Var.Body with the tree of the assigned values
 	ParseVarBody bool
-	tokens       []lexer.Token
-	c            int
-	lastComments []string
+	// WarnMixedLineEndings makes ParseRecover report a warning for files mixing LF and CRLF line endings
+	WarnMixedLineEndings bool
+	tokens               []lexer.Token
+	c                    int
+	lastComments         []string
+	recovering           bool
+	diagnostics          Diagnostics
+	// recipePrefix is the current value of .RECIPEPREFIX, empty meaning a tab
+	recipePrefix string
+	// inRecipe is set while parsing a recipe line
+	inRecipe bool
+	// posix is set once the .POSIX special target is defined
+	posix bool
 }
 
 func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
@@ -76,7 +143,12 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 		return p.root(p.peekn(0))
 	}
 
+	if p.eatDirectiveIndent() {
+		return p.root(p.peekn(0))
+	}
+
 	if lexer.NewMatcher("Char", "-", "+").Is(t) {
+		start := p.c
 		m := p.advance() // Eat modifier
 
 		n, err := p.root(p.peekn(0))
@@ -84,10 +156,13 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 			return nil, err
 		}
 
-		return &Modifier{
+		mod := &Modifier{
 			Modifier: m.Value,
 			Node:     n,
-		}, nil
+		}
+		p.span(mod, start)
+
+		return mod, nil
 	}
 
 	defer func() {
@@ -97,6 +172,14 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 		}
 	}()
 
+	if override, export, n := p.definePrefixes(); n > 0 {
+		start := p.c
+		p.c += n
+		p.advance() // Eat define keyword
+
+		return p.define(start, override, export)
+	}
+
 	switch t.Type {
 	case lexer.EOF:
 		p.advance() // Eat EOF
@@ -110,22 +193,39 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 		switch t.Value {
 		case "include":
 			return p.include()
+		case "sinclude":
+			n, err := p.include()
+			if err != nil {
+				return nil, err
+			}
+
+			// sinclude is the same as -include
+			mod := &Modifier{
+				Modifier: "-",
+				Node:     n,
+			}
+			mod.SetPos(n.Pos().Start, n.Pos().End)
+
+			return mod, nil
 		case "define":
-			return p.define()
+			return p.define(p.c-1, false, false)
 		case "ifeq", "ifneq":
 			return p.ifeq(t)
 		case "ifdef", "ifndef":
 			return p.ifdef(t)
-		case "endif", "endef":
+		case "endif", "endef", "else":
 			return nil, p.ut(t)
 		}
 
-		panic("keyword `" + t.Value + "` needs implementing")
+		return nil, p.errat(t, "unsupported keyword `%v`", t.Value)
 	}
 
+	start := p.c
 	exp, err := p.expr(false, lexer.NewMultiMatcher(
 		NlMatcher,
 		lexer.NewMatcher("Colon"),
+		lexer.NewMatcher("DoubleColon"),
+		lexer.NewMatcher("GroupedColon"),
 		lexer.NewMatcher("AssignOp"),
 	))
 	if err != nil {
@@ -134,9 +234,9 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 
 	opt := p.peekn(0)
 	switch opt.Type {
-	case lexer.Symbol("Colon"):
-		p.advance() // Eat :
-		return p.target(exp)
+	case lexer.Symbol("Colon"), lexer.Symbol("DoubleColon"), lexer.Symbol("GroupedColon"):
+		p.advance() // Eat :, :: or &:
+		return p.target(start, exp, opt)
 	}
 
 	if exp != nil {
@@ -146,7 +246,14 @@ func (p *Parser) root(t lexer.Token) (outNode Node, rerr error) {
 
 		case lexer.Symbol("AssignOp"):
 			p.advance() // Eat op
-			return p.varass(exp, opt)
+			n, err := p.varass(start, exp, opt)
+			if err != nil {
+				return nil, err
+			}
+
+			p.setRecipePrefix(n.(*Var))
+
+			return n, nil
 		}
 
 		return exp, nil
@@ -159,6 +266,57 @@ func (p *Parser) Parse() (Node, error) {
 	return p.parse()
 }
 
+// ParseRecover parses the whole input, resuming at the next line whenever an error is found.
+// It returns the nodes that could be parsed, along with every problem encountered.
+func (p *Parser) ParseRecover() (Node, Diagnostics) {
+	p.recovering = true
+	defer func() {
+		p.recovering = false
+	}()
+
+	if p.WarnMixedLineEndings {
+		p.checkLineEndings()
+	}
+
+	n, _ := p.parse()
+
+	return n, p.diagnostics
+}
+
+// checkLineEndings warns about the first line ending that differs from the one of the first line
+func (p *Parser) checkLineEndings() {
+	var first *lexer.Token
+	for i, t := range p.tokens {
+		if !strings.HasSuffix(t.Value, "\n") {
+			continue
+		}
+
+		if first == nil {
+			first = &p.tokens[i]
+			continue
+		}
+
+		if strings.HasSuffix(t.Value, "\r\n") == strings.HasSuffix(first.Value, "\r\n") {
+			continue
+		}
+
+		name := func(t lexer.Token) string {
+			if strings.HasSuffix(t.Value, "\r\n") {
+				return "CRLF"
+			}
+			return "LF"
+		}
+
+		p.diagnostics = append(p.diagnostics, Diagnostic{
+			Pos:      t.Pos,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("mixed line endings, %v here but %v on line %v", name(t), name(*first), first.Pos.Line),
+		})
+
+		return
+	}
+}
+
 func (p *Parser) ParseExpr() (Node, error) {
 	return p.expr(false, lexer.NewMatcher("EOF"))
 }
@@ -174,7 +332,13 @@ func (p *Parser) parse() (Node, error) {
 				break
 			}
 
-			return nodes, err
+			if !p.recovering {
+				return nodes, err
+			}
+
+			p.report(err)
+			p.sync()
+			continue
 		}
 		nodes = append(nodes, n)
 	}
@@ -187,6 +351,8 @@ func (p *Parser) parse() (Node, error) {
 }
 
 func (p *Parser) include() (*Include, error) {
+	start := p.c - 1 // include keyword
+
 	p.eatall(lexer.NewMatcher("Char", " "))
 
 	expr, err := p.expr(true, lexer.NewMatcher("Nl"))
@@ -194,9 +360,12 @@ func (p *Parser) include() (*Include, error) {
 		return nil, err
 	}
 
-	return &Include{
+	n := &Include{
 		Path: expr,
-	}, nil
+	}
+	p.span(n, start)
+
+	return n, nil
 }
 
 func (p *Parser) expr(eat bool, matcher lexer.Matcher) (_ Node, rerr error) {
@@ -222,6 +391,7 @@ func (p *Parser) _expr(o exprOptions) (_ Node, rerr error) {
 		}
 	}()
 
+	start := p.c
 	expr := &Expr{}
 
 	for {
@@ -244,12 +414,12 @@ func (p *Parser) _expr(o exprOptions) (_ Node, rerr error) {
 		}
 
 		raw, err := p.raw(func(t lexer.Token) (bool, bool) {
-			if lexer.NewMultiMatcher(lexer.NewMatcher("ExpVar"), lexer.NewMatcher("ExpStart"), lexer.NewMatcher("ExpEnd")).Is(t) {
+			if lexer.NewMultiMatcher(lexer.NewMatcher("ExpVar"), expStartMatcher, expEndMatcher).Is(t) {
 				return true, false
 			}
 
 			return o.rawMatcher.Is(t), false
-		}, o.rawDrop)
+		}, o.rawDrop, p.unescape)
 		if err != nil {
 			return nil, err
 		}
@@ -268,6 +438,8 @@ func (p *Parser) _expr(o exprOptions) (_ Node, rerr error) {
 		return expr.Parts[0], nil
 	}
 
+	p.span(expr, start)
+
 	return expr, nil
 }
 
@@ -278,9 +450,10 @@ func (p *Parser) exp() (_ Node, rerr error) {
 		}
 	}()
 
+	start := p.c
 	t := p.peekn(0)
-	if lexer.NewMatcher("ExpStart").Is(t) {
-		p.advance() // Eat $(
+	if expStartMatcher.Is(t) {
+		p.advance() // Eat $( or ${
 		exp := &Exp{}
 
 		for {
@@ -289,8 +462,13 @@ func (p *Parser) exp() (_ Node, rerr error) {
 				return nil, p.err("unexpected eof")
 			}
 
-			if lexer.NewMatcher("ExpEnd").Is(t) {
-				p.advance() // Eat )
+			if expEndMatcher.Is(t) {
+				if err := p.unterminated(t); err != nil {
+					return nil, err
+				}
+
+				p.advance() // Eat ) or }
+				p.span(exp, start)
 				return exp, nil
 			}
 
@@ -307,22 +485,29 @@ func (p *Parser) exp() (_ Node, rerr error) {
 					return nil, err
 				}
 				if pattern == nil {
-					pattern = &Raw{}
+					pattern = p.emptyRaw()
 				}
 
-				subst, err := p.expr(true, lexer.NewMatcher("ExpEnd", ")"))
+				subst, err := p.expr(false, expEndMatcher)
 				if err != nil {
 					return nil, err
 				}
+				if err := p.unterminated(p.peekn(0)); err != nil {
+					return nil, err
+				}
+				p.advance() // Eat ) or }
 				if subst == nil {
-					subst = &Raw{}
+					subst = p.emptyRaw()
 				}
 
-				return &PatSubst{
+				n := &PatSubst{
 					Name:    exp.Parts[0],
 					Pattern: pattern,
 					Subst:   subst,
-				}, nil
+				}
+				p.span(n, start)
+
+				return n, nil
 			}
 
 			isFirst := len(exp.Parts) == 0
@@ -350,25 +535,55 @@ func (p *Parser) exp() (_ Node, rerr error) {
 					return exp, p.ut(t)
 				}
 
-				part = &Raw{}
+				part = p.emptyRaw()
 			}
 
 			exp.Parts = append(exp.Parts, part)
 		}
 	} else if lexer.NewMatcher("ExpVar").Is(t) {
 		p.advance() // Eat $...
-		return &Exp{
-			Parts: []Node{&Raw{Text: strings.TrimPrefix(t.Value, "$")}},
-		}, nil
+
+		name := &Raw{Text: strings.TrimPrefix(t.Value, "$")}
+		name.SetPos(lexer.Token{Pos: t.Pos, Value: "$"}.End(), t.End())
+
+		exp := &Exp{
+			Parts: []Node{name},
+		}
+		p.span(exp, start)
+
+		return exp, nil
 	}
 
 	return nil, nil
 }
 
+// unterminated checks the end of a variable reference t, which the lexer leaves empty when the line ends first.
+// When recovering, the error is reported and the reference is considered closed.
+func (p *Parser) unterminated(t lexer.Token) error {
+	if t.Value != "" {
+		return nil
+	}
+
+	err := &traceErr{
+		pos: t.Pos,
+		err: errors.New("unterminated variable reference"),
+	}
+	if !p.recovering {
+		return err
+	}
+
+	// The references closed by the same end of line are reported once
+	if n := len(p.diagnostics); n == 0 || p.diagnostics[n-1].Pos != t.Pos {
+		p.report(err)
+	}
+	return nil
+}
+
 type UntilFunc func(token lexer.Token) (bool, bool)
 type DropFunc func(token lexer.Token) bool
+type TextFunc func(token lexer.Token) string
 
-func (p *Parser) raw(until UntilFunc, drop DropFunc) (_ *Raw, rerr error) {
+func (p *Parser) raw(until UntilFunc, drop DropFunc, text TextFunc) (_ *Raw, rerr error) {
 	defer func() {
 		if rerr != nil {
 			rerr = p.wrap("raw", rerr)
@@ -379,10 +594,19 @@ func (p *Parser) raw(until UntilFunc, drop DropFunc) (_ *Raw, rerr error) {
 			return false
 		}
 	}
+	if text == nil {
+		text = func(token lexer.Token) string {
+			return token.Value
+		}
+	}
 
+	start := p.c
 	acc := ""
 	for {
-		p.eat(lexer.NewMatcher("Comment"))
+		// Comments are part of the command in recipes
+		if !p.inRecipe {
+			p.eat(lexer.NewMatcher("Comment"))
+		}
 
 		t := p.peekn(0)
 		if lexer.NewMatcher("EOF").Is(t) {
@@ -397,18 +621,80 @@ func (p *Parser) raw(until UntilFunc, drop DropFunc) (_ *Raw, rerr error) {
 		}
 
 		p.advance()
-		if !drop(t) {
-			acc += t.Value
+		if drop(t) {
+			continue
+		}
+
+		if continuationMatcher.Is(t) {
+			acc = p.continuation(acc)
+			continue
+		}
+
+		// Like make, CRLF is a plain newline
+		if NlMatcher.Is(t) {
+			acc += "\n"
+			continue
 		}
+
+		acc += text(t)
 	}
 
 	if acc == "" {
 		return nil, nil
 	}
-	return &Raw{Text: acc}, nil
+
+	n := &Raw{Text: acc}
+	p.span(n, start)
+
+	return n, nil
 }
 
-func (p *Parser) varass(name Node, opt lexer.Token) (_ Node, rerr error) {
+// continuation folds the backslash-newline following acc like make:
+// recipes keep it for the shell, elsewhere it is a single space
+func (p *Parser) continuation(acc string) string {
+	if p.inRecipe {
+		// Only the recipe prefix starting the next line is removed
+		if p.isRecipePrefix(p.peekn(0)) {
+			p.advance()
+		}
+
+		return acc + "\\\n"
+	}
+
+	if p.posix {
+		// POSIX keeps the whitespace before the backslash, and each continuation is a space
+		p.eatall(lexer.NewMultiMatcher(lexer.NewMatcher("Char", " "), lexer.NewMatcher("Tab")))
+
+		return acc + " "
+	}
+
+	p.eatall(blankMatcher)
+
+	return strings.TrimRight(acc, " \t") + " "
+}
+
+// unescape returns the text t stands for in an expression: like make, `$$` is a `$`
+// and, outside of recipes which are left to the shell, `\#` is a `#`
+func (p *Parser) unescape(t lexer.Token) string {
+	switch {
+	case lexer.NewMatcher("Escaped", "$$").Is(t):
+		return "$"
+	case lexer.NewMatcher("Escaped", "\\#").Is(t) && !p.inRecipe:
+		return "#"
+	}
+
+	return t.Value
+}
+
+// emptyRaw returns an empty Raw positioned at the current token
+func (p *Parser) emptyRaw() *Raw {
+	n := &Raw{}
+	p.span(n, p.c)
+
+	return n
+}
+
+func (p *Parser) varass(start int, name Node, opt lexer.Token) (_ Node, rerr error) {
 	defer func() {
 		if rerr != nil {
 			rerr = p.wrap("varass", rerr)
@@ -419,24 +705,59 @@ func (p *Parser) varass(name Node, opt lexer.Token) (_ Node, rerr error) {
 		return strings.TrimSpace(s)
 	})
 
-	p.eat(lexer.NewMatcher("Char", " "))
+	// Like make, the value starts at its first non-blank character
+	p.eatall(blankMatcher)
+
+	var body Node
+	if p.ParseVarBody {
+		valueStart := p.c
 
+		var err error
+		body, err = p.expr(false, NlMatcher)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			body = p.emptyRaw()
+		}
+
+		// Go over the value again to keep its text
+		p.c = valueStart
+	}
+
+	rawStart := p.c
 	expr, err := p.raw(func(t lexer.Token) (bool, bool) {
 		return NlMatcher.Is(t), true
-	}, nil)
+	}, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	// Like make, a value expanded right away must be well formed, the others only when they are used
+	if !p.ParseVarBody && (opt.Value == ":=" || opt.Value == "::=" || opt.Value == "!=") {
+		for _, t := range p.tokens[rawStart:p.c] {
+			if expEndMatcher.Is(t) && t.Value == "" {
+				if err := p.unterminated(t); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
 	if expr == nil {
 		expr = &Raw{}
 	}
 
-	return &Var{
+	n := &Var{
 		Name:  name,
 		Op:    opt.Value,
 		Value: expr.Text,
-	}, nil
+		Body:  body,
+	}
+	p.span(n, start)
+
+	return n, nil
 }
 
 func (p *Parser) ifeq(t lexer.Token) (_ Node, rerr error) {
@@ -446,42 +767,127 @@ func (p *Parser) ifeq(t lexer.Token) (_ Node, rerr error) {
 		}
 	}()
 
-	p.eatall(lexer.NewMatcher("Char", " "))
+	start := p.c - 1 // ifeq keyword
 
-	_, err := p.expect(lexer.NewMatcher("Char", "("))
+	p.eatall(blankMatcher)
+
+	var left, right Node
+	var err error
+	if quoteMatcher.Is(p.peekn(0)) {
+		left, right, err = p.ifeqQuotedArgs()
+	} else {
+		left, right, err = p.ifeqArgs()
+	}
+	if err == nil {
+		// Like make, only blanks and a comment may follow the arguments
+		p.eatall(blankMatcher)
+		p.eat(lexer.NewMatcher("Comment"))
+		if next := p.peekn(0); !NlMatcher.Is(next) && !isEOF(next) {
+			err = p.err("extraneous text after '%v' directive", t.Value)
+		}
+	}
+	if err != nil {
+		if err := p.recoverLine("ifeq", err, start); err != nil {
+			return nil, err
+		}
+
+		if left == nil {
+			left = p.emptyRaw()
+		}
+		if right == nil {
+			right = p.emptyRaw()
+		}
+	}
+	p.eatall(NlMatcher)
+
+	body, els, err := p.ifbody()
 	if err != nil {
 		return nil, err
 	}
 
+	n := &IfEq{
+		Expected: t.Value == "ifeq",
+		Left:     left,
+		Right:    right,
+		Body:     body,
+		Else:     els,
+	}
+	p.span(n, start)
+
+	return n, nil
+}
+
+// ifeqArgs parses the `(a,b)` form of the arguments of ifeq
+func (p *Parser) ifeqArgs() (Node, Node, error) {
+	_, err := p.expect(lexer.NewMatcher("Char", "("))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	left, err := p.expr(true, lexer.NewMatcher("Char", ","))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if left == nil {
-		left = &Raw{}
+		left = p.emptyRaw()
 	}
 
+	// Like make, strip the whitespace after the first argument
+	// and before the second one
+	Trim(left, func(s string) string {
+		return strings.TrimRight(s, " \t")
+	})
+	p.eatall(blankMatcher)
+
 	right, err := p.expr(true, lexer.NewMatcher("Char", ")"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if right == nil {
-		right = &Raw{}
+		right = p.emptyRaw()
 	}
 
-	p.eatall(NlMatcher)
+	return left, right, nil
+}
+
+var quoteMatcher = lexer.NewMatcher("Char", `"`, "'")
 
-	body, err := p.ifbody()
+// ifeqQuotedArgs parses the `"a" "b"` form of the arguments of ifeq, each argument being either double or single quoted
+func (p *Parser) ifeqQuotedArgs() (Node, Node, error) {
+	arg := func() (Node, error) {
+		q, err := p.expect(quoteMatcher)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := p.expr(false, lexer.NewMultiMatcher(lexer.NewMatcher("Char", q.Value), NlMatcher))
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			n = p.emptyRaw()
+		}
+
+		if _, err := p.expect(lexer.NewMatcher("Char", q.Value)); err != nil {
+			return nil, err
+		}
+
+		return n, nil
+	}
+
+	left, err := arg()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &IfEq{
-		Expected: t.Value == "ifeq",
-		Left:     left,
-		Right:    right,
-		Body:     body,
-	}, nil
+	p.eatall(blankMatcher)
+
+	right, err := arg()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return left, right, nil
 }
 
 func (p *Parser) ifdef(t lexer.Token) (_ Node, rerr error) {
@@ -491,80 +897,207 @@ func (p *Parser) ifdef(t lexer.Token) (_ Node, rerr error) {
 		}
 	}()
 
+	start := p.c - 1 // ifdef keyword
+
 	p.eatall(lexer.NewMatcher("Char", " "))
 
 	ident, err := p.expectIdent()
 	if err != nil {
-		return nil, err
+		if err := p.recoverLine("ifdef", err, start); err != nil {
+			return nil, err
+		}
 	}
 
 	p.eatall(NlMatcher)
 
-	body, err := p.ifbody()
+	body, els, err := p.ifbody()
 	if err != nil {
 		return nil, err
 	}
 
-	return &IfDef{
+	n := &IfDef{
 		Expected: t.Value == "ifdef",
 		Ident:    ident,
 		Body:     body,
-	}, nil
+		Else:     els,
+	}
+	p.span(n, start)
+
+	return n, nil
 }
 
-func (p *Parser) ifbody() (_ []Node, rerr error) {
+// ifbody parses the body of a conditional, up to the matching endif.
+// When the body is terminated by an else, the else branch is returned
+// as well; an `else ifeq ...` style branch is returned as a single
+// nested conditional node.
+func (p *Parser) ifbody() (_ []Node, _ []Node, rerr error) {
 	defer func() {
 		if rerr != nil {
 			rerr = p.wrap("ifbody", rerr)
 		}
 	}()
 
+	body, err := p.condbody()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := p.advance() // Eat else or endif
+	if t.Value != "else" {
+		// When recovering, the end of the file may end the conditional
+		return body, nil, nil
+	}
+
+	elseStart := p.c - 1
+	p.eatall(blankMatcher)
+
+	t = p.peekn(0)
+	if lexer.NewMatcher("Keyword").Is(t) {
+		p.advance() // Eat keyword
+
+		var n Node
+		switch t.Value {
+		case "ifeq", "ifneq":
+			n, err = p.ifeq(t)
+		case "ifdef", "ifndef":
+			n, err = p.ifdef(t)
+		default:
+			err = p.recoverLine("else", p.ut(t), elseStart)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if n != nil {
+			return body, []Node{n}, nil
+		}
+	}
+
+	els, err := p.condbody()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		t = p.advance() // Eat else or endif
+		if t.Value != "else" {
+			return body, els, nil
+		}
+
+		// When recovering, the extra branches are kept in the else branch, up to the endif
+		err := p.recoverLine("ifbody", p.errat(t, "only one `else` per conditional"), p.c-1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		more, err := p.condbody()
+		if err != nil {
+			return nil, nil, err
+		}
+		els = append(els, more...)
+	}
+}
+
+// eatDirectiveIndent eats the blanks indenting a directive, returning whether there were any
+func (p *Parser) eatDirectiveIndent() bool {
+	i := p.c
+	for blankMatcher.Is(p.tokenAt(i)) {
+		i++
+	}
+	if i == p.c {
+		return false
+	}
+
+	t := p.tokenAt(i)
+	if lexer.NewMatcher("Char", "-").Is(t) {
+		t = p.tokenAt(i + 1)
+	}
+	if !lexer.NewMatcher("Keyword").Is(t) {
+		return false
+	}
+
+	p.c = i
+
+	return true
+}
+
+// condbody parses nodes until an else or endif, which is left unconsumed
+func (p *Parser) condbody() ([]Node, error) {
 	body := make([]Node, 0)
 	for {
 		p.eatall(lexer.NewMultiMatcher(lexer.NewMatcher("Nl"), lexer.NewMatcher("Comment")))
+		p.eatDirectiveIndent()
 
 		t := p.peekn(0)
 		if isEOF(t) {
-			return nil, p.err("unexpected eof")
+			err := p.err("unexpected eof")
+			if !p.recovering {
+				return nil, err
+			}
+
+			// The conditional is kept with the nodes found so far
+			p.report(err)
+			return body, nil
 		}
 
-		if lexer.NewMatcher("Keyword", "endif").Is(t) {
-			p.advance() // Eat endif
+		if lexer.NewMatcher("Keyword", "endif", "else").Is(t) {
 			return body, nil
 		}
 
 		n, err := p.root(t)
-		if err != nil {
-			return body, err
+		if err == nil && n == nil {
+			err = p.ut(t)
 		}
+		if err != nil {
+			if !p.recovering || errors.Is(err, io.EOF) {
+				return body, err
+			}
 
-		if n == nil {
-			return body, p.ut(t)
+			p.report(err)
+			p.sync()
+			continue
 		}
 
 		body = append(body, n)
 	}
 }
 
-func (p *Parser) recipe() ([]Node, error) {
+var semicolonMatcher = lexer.NewMatcher("Char", ";")
+
+// recipe parses the recipe of a rule whose line ended with t,
+// a `; command` ending the line being the first recipe line
+func (p *Parser) recipe(t lexer.Token) ([]Node, error) {
 	cmds := make([]Node, 0)
+
+	p.inRecipe = true
+	defer func() {
+		p.inRecipe = false
+	}()
+
+	if semicolonMatcher.Is(t) {
+		cmd, err := p.recipeLine()
+		if err != nil {
+			return cmds, err
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
 	for {
-		if !p.eat(lexer.NewMatcher("Tab")) {
+		if !p.isRecipePrefix(p.peekn(0)) {
 			break
 		}
+		p.advance() // Eat recipe prefix
 
 		if p.eat(lexer.NewMatcher("Comment")) {
 			p.advance() // Eat \n
 			continue
 		}
 
-		cmd, err := p.expr(true, NlMatcher)
+		cmd, err := p.recipeLine()
 		if err != nil {
 			return cmds, err
 		}
-		if cmd == nil {
-			return nil, p.ut(p.peekn(0))
-		}
 
 		cmds = append(cmds, cmd)
 	}
@@ -572,7 +1105,90 @@ func (p *Parser) recipe() ([]Node, error) {
 	return cmds, nil
 }
 
-func (p *Parser) target(name Node) (_ Node, rerr error) {
+var recipeFlagMatcher = lexer.NewMatcher("Char", "@", "-", "+")
+
+// recipeLine parses a recipe command along with the `@`, `-` and `+` flags prefixing it,
+// which like in make can be repeated and mixed with blanks
+func (p *Parser) recipeLine() (_ *RecipeLine, rerr error) {
+	defer func() {
+		if rerr != nil {
+			rerr = p.wrap("recipeLine", rerr)
+		}
+	}()
+
+	p.eatall(blankMatcher)
+	start := p.c
+
+	n := &RecipeLine{}
+	for {
+		if p.eat(blankMatcher) {
+			continue
+		}
+
+		t := p.peekn(0)
+		if !recipeFlagMatcher.Is(t) {
+			break
+		}
+		p.advance()
+
+		switch t.Value {
+		case "@":
+			n.Silent = true
+		case "-":
+			n.IgnoreErrors = true
+		case "+":
+			n.Always = true
+		}
+	}
+
+	cmd, err := p.expr(true, NlMatcher)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil {
+		cmd = p.emptyRaw()
+	}
+	n.Cmd = cmd
+
+	p.span(n, start)
+
+	return n, nil
+}
+
+// setRecipePrefix tracks assignments to .RECIPEPREFIX, whose first character starts the recipe lines that follow
+func (p *Parser) setRecipePrefix(v *Var) {
+	name, ok := v.Name.(*Raw)
+	if !ok || name.Text != ".RECIPEPREFIX" {
+		return
+	}
+
+	switch v.Op {
+	case "+=", "!=":
+		return
+	case "?=":
+		if p.recipePrefix != "" {
+			return
+		}
+	}
+
+	p.recipePrefix = ""
+	for _, r := range v.Value {
+		if r != '\t' {
+			p.recipePrefix = string(r)
+		}
+		break
+	}
+}
+
+func (p *Parser) isRecipePrefix(t lexer.Token) bool {
+	if p.recipePrefix == "" {
+		return lexer.NewMatcher("Tab").Is(t)
+	}
+
+	return !lexer.NewMultiMatcher(NlMatcher, lexer.NewMatcher("EOF")).Is(t) && t.Value == p.recipePrefix
+}
+
+func (p *Parser) target(start int, name Node, sep lexer.Token) (_ Node, rerr error) {
 	defer func() {
 		if rerr != nil {
 			rerr = p.wrap("target", rerr)
@@ -583,47 +1199,202 @@ func (p *Parser) target(name Node) (_ Node, rerr error) {
 
 	if name == nil {
 		name = &Raw{}
+		p.span(name, start)
 	}
 
-	expr, err := p.expr(false, lexer.NewMultiMatcher(
+	if raw, ok := name.(*Raw); ok && strings.TrimSpace(raw.Text) == ".POSIX" {
+		p.posix = true
+	}
+
+	depsStart := p.c
+	expr, orderOnly, err := p.prereqs(lexer.NewMultiMatcher(
 		NlMatcher,
 		lexer.NewMatcher("Colon"),
+		lexer.NewMatcher("AssignOp"),
+		semicolonMatcher,
 	))
-	if rerr != nil {
+	if err != nil {
 		return nil, err
 	}
 
-	t := p.advance() // Eat \n or :
+	t := p.advance() // Eat \n, :, ; or op
 
-	if lexer.NewMultiMatcher(NlMatcher, lexer.NewMatcher("EOF")).Is(t) {
-		cmds, err := p.recipe()
-		if rerr != nil {
+	if lexer.NewMatcher("AssignOp").Is(t) && orderOnly == nil {
+		return p.targetVar(start, name, depsStart, expr, t)
+	}
+
+	if lexer.NewMultiMatcher(NlMatcher, lexer.NewMatcher("EOF"), semicolonMatcher).Is(t) {
+		cmds, err := p.recipe(t)
+		if err != nil {
 			return nil, err
 		}
 
-		return &Target{
-			Name:   name,
-			Deps:   expr,
-			Recipe: cmds,
-		}, nil
+		n := &Target{
+			Name:        name,
+			Deps:        expr,
+			OrderOnly:   orderOnly,
+			Recipe:      cmds,
+			DoubleColon: lexer.NewMatcher("DoubleColon").Is(sep),
+			Grouped:     lexer.NewMatcher("GroupedColon").Is(sep),
+		}
+		p.span(n, start)
+
+		return n, nil
 	}
 
-	prereq, err := p.expr(true, NlMatcher)
-	if rerr != nil {
+	if orderOnly != nil {
+		return nil, p.ut(t)
+	}
+
+	p.eatall(blankMatcher)
+
+	prereq, orderOnly, err := p.prereqs(lexer.NewMultiMatcher(NlMatcher, semicolonMatcher))
+	if err != nil {
 		return nil, err
 	}
+	t = p.advance() // Eat \n or ;
+
+	cmds, err := p.recipe(t)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &StaticPatternTarget{
+		Names:     name,
+		Targets:   expr,
+		Prereqs:   prereq,
+		OrderOnly: orderOnly,
+		Recipe:    cmds,
+	}
+	p.span(n, start)
+
+	return n, nil
+}
+
+// prereqs parses prerequisites up to stop, the ones after a `|` being order-only
+func (p *Parser) prereqs(stop lexer.Matcher) (_ Node, _ Node, rerr error) {
+	defer func() {
+		if rerr != nil {
+			rerr = p.wrap("prereqs", rerr)
+		}
+	}()
+
+	pipe := lexer.NewMatcher("Char", "|")
+
+	trim := func(s string) string {
+		return strings.TrimRight(s, " \t")
+	}
+
+	deps, err := p.expr(false, lexer.NewMultiMatcher(stop, pipe))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	Trim(deps, trim)
+
+	if !p.eat(pipe) {
+		return deps, nil, nil
+	}
+
+	p.eatall(blankMatcher)
+
+	orderOnly, err := p.expr(false, stop)
+	if err != nil {
+		return nil, nil, err
+	}
+	if orderOnly == nil {
+		orderOnly = p.emptyRaw()
+	}
+	Trim(orderOnly, trim)
+
+	return deps, orderOnly, nil
+}
+
+var targetVarPrefixes = []string{"override", "export", "private"}
+
+func (p *Parser) targetVar(start int, targets Node, nameStart int, name Node, op lexer.Token) (_ Node, rerr error) {
+	defer func() {
+		if rerr != nil {
+			rerr = p.wrap("targetvar", rerr)
+		}
+	}()
+
+	if name == nil {
+		return nil, p.errat(op, "expected variable name")
+	}
+
+	n := &TargetVar{
+		Targets: targets,
+	}
+
+	prefixes := trimPrefixWords(name, targetVarPrefixes)
+	for _, prefix := range prefixes {
+		switch prefix {
+		case "override":
+			n.Override = true
+		case "export":
+			n.Export = true
+		case "private":
+			n.Private = true
+		}
+	}
 
-	cmds, err := p.recipe()
-	if rerr != nil {
+	v, err := p.varass(nameStart, name, op)
+	if err != nil {
 		return nil, err
 	}
 
-	return &StaticPatternTarget{
-		Names:   name,
-		Targets: expr,
-		Prereqs: prereq,
-		Recipe:  cmds,
-	}, nil
+	n.Var = v.(*Var)
+	n.Var.SetPos(name.Pos().Start, n.Var.Pos().End)
+	p.span(n, start)
+
+	return n, nil
+}
+
+// trimPrefixWords removes the leading words of n that are in words, returning them
+func trimPrefixWords(n Node, words []string) []string {
+	raw, ok := n.(*Raw)
+	if expr, isExpr := n.(*Expr); isExpr {
+		raw, ok = expr.Parts[0].(*Raw)
+	}
+	if !ok {
+		return nil
+	}
+
+	found := make([]string, 0)
+	for {
+		text := strings.TrimLeft(raw.Text, " \t")
+		i := strings.IndexAny(text, " \t")
+		if i < 0 || !contains(words, text[:i]) {
+			break
+		}
+
+		found = append(found, text[:i])
+		text = strings.TrimLeft(text[i:], " \t")
+
+		start := raw.Pos().Start
+		start.Offset += len(raw.Text) - len(text)
+		start.Column += utf8.RuneCountInString(raw.Text) - utf8.RuneCountInString(text)
+		raw.Text = text
+		raw.SetPos(start, raw.Pos().End)
+	}
+
+	if expr, isExpr := n.(*Expr); isExpr && raw.Text == "" {
+		expr.Parts = expr.Parts[1:]
+		expr.SetPos(expr.Parts[0].Pos().Start, expr.Pos().End)
+	}
+
+	return found
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (p *Parser) expectIdent() (string, error) {
@@ -641,7 +1412,7 @@ func (p *Parser) expectIdent() (string, error) {
 			lexer.NewMatcher("Keyword"),
 			lexer.NewMatcher("Escaped"),
 		).Is(t), false
-	}, nil)
+	}, nil, nil)
 	if err != nil {
 		return "", err
 	}
@@ -651,38 +1422,128 @@ func (p *Parser) expectIdent() (string, error) {
 	return ident.Text, nil
 }
 
-func (p *Parser) define() (_ Node, rerr error) {
+// definePrefixes looks for `override` and `export` words introducing a define,
+// returning the number of tokens they span, 0 meaning that there is no such define ahead
+func (p *Parser) definePrefixes() (override, export bool, n int) {
+	word := ""
+	for i := p.c; i < len(p.tokens); i++ {
+		t := p.tokens[i]
+
+		switch {
+		case blankMatcher.Is(t) || lexer.NewMatcher("Keyword", "define").Is(t):
+			switch word {
+			case "override":
+				override = true
+			case "export":
+				export = true
+			case "":
+				if !override && !export {
+					return false, false, 0
+				}
+			default:
+				return false, false, 0
+			}
+			word = ""
+
+			if lexer.NewMatcher("Keyword", "define").Is(t) {
+				return override, export, i - p.c
+			}
+		case lexer.NewMatcher("Char").Is(t) && t.Value != "\n":
+			word += t.Value
+		default:
+			return false, false, 0
+		}
+	}
+
+	return false, false, 0
+}
+
+func (p *Parser) define(start int, override, export bool) (_ Node, rerr error) {
 	defer func() {
 		if rerr != nil {
 			rerr = p.wrap("define", rerr)
 		}
 	}()
 
-	p.eatall(lexer.NewMatcher("Char", " "))
+	p.eatall(blankMatcher)
 
 	ident, err := p.expectIdent()
 	if err != nil {
 		return nil, err
 	}
 
-	p.eatall(lexer.NewMatcher("Char", " "))
-	p.eat(NlMatcher)
+	p.eatall(blankMatcher)
 
+	op := ""
+	if t := p.peekn(0); lexer.NewMatcher("AssignOp").Is(t) {
+		p.advance() // Eat op
+		op = t.Value
+	}
+
+	p.eatall(blankMatcher)
+	if _, err := p.expect(lexer.NewMultiMatcher(NlMatcher, lexer.NewMatcher("EOF"))); err != nil {
+		return nil, err
+	}
+
+	// Like make, only count the define and endef starting a line that is not a recipe line,
+	// so that templates can hold nested defines
+	depth := 1
+	first, lineStart := true, true
 	body, err := p.raw(func(t lexer.Token) (bool, bool) {
-		return lexer.NewMatcher("Keyword", "endef").Is(t), true
-	}, nil)
+		wasFirst := first
+		first = false
+
+		if NlMatcher.Is(t) {
+			first, lineStart = true, true
+			return false, false
+		}
+		if !lineStart {
+			return false, false
+		}
+
+		word := lexer.NewMultiMatcher(blankMatcher, NlMatcher, lexer.NewMatcher("Comment"), lexer.NewMatcher("EOF")).Is(p.peekn(1))
+		switch {
+		case wasFirst && p.isRecipePrefix(t):
+			lineStart = false
+		case blankMatcher.Is(t):
+		case word && lexer.NewMatcher("Keyword", "define").Is(t):
+			lineStart = false
+			depth++
+		case word && lexer.NewMatcher("Keyword", "endef").Is(t):
+			lineStart = false
+			depth--
+
+			return depth == 0, true
+		default:
+			lineStart = false
+		}
+
+		return false, false
+	}, nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	if depth > 0 {
+		return nil, p.errat(p.peekn(0), "missing `endef`, unterminated `define`")
+	}
 
-	Trim(body, func(s string) string {
-		return strings.TrimSuffix(s, "\n")
-	})
+	text := ""
+	if body != nil {
+		// Drop the indentation of endef along with the last newline
+		text = strings.TrimRight(body.Text, " \t")
+		text = strings.TrimSuffix(text, "\n")
+	}
+
+	n := &Define{
+		Name:     ident,
+		Op:       op,
+		Body:     text,
+		Override: override,
+		Export:   export,
+	}
+	p.span(n, start)
 
-	return &Define{
-		Name: ident,
-		Body: body.Text,
-	}, nil
+	return n, nil
 }
 
 func Trim(n Node, f func(s string) string) {
@@ -692,6 +1553,10 @@ func Trim(n Node, f func(s string) string) {
 
 	last := n
 	if expr, ok := last.(*Expr); ok {
+		if len(expr.Parts) == 0 {
+			return
+		}
+
 		last = expr.Parts[len(expr.Parts)-1]
 	}
 
@@ -2,11 +2,13 @@ package parser
 
 import (
 	"github.com/stretchr/testify/assert"
+	"mxplrr/lexer"
+	"strings"
 	"testing"
 )
 
-func parse(t *testing.T, s string) Node {
-	p, err := NewParserString(s)
+func parsePos(t *testing.T, s string) Node {
+	p, err := NewParserFilename("Makefile", strings.NewReader(s))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -19,6 +21,18 @@ func parse(t *testing.T, s string) Node {
 	return node
 }
 
+// parse parses s, stripping positions to keep the expected trees readable
+func parse(t *testing.T, s string) Node {
+	node := parsePos(t, s)
+
+	Walk(node, func(n Node) bool {
+		n.SetPos(lexer.Position{}, lexer.Position{})
+		return true
+	})
+
+	return node
+}
+
 func TestParseTarget(t *testing.T) {
 	n := parse(t, `
 T.%/: $(A) test \
@@ -44,9 +58,7 @@ T.%/: $(A) test \
 			},
 		},
 		Recipe: []Node{
-			&Raw{
-				Text: "@echo",
-			},
+			&RecipeLine{Silent: true, Cmd: &Raw{Text: "echo"}},
 		},
 	}, n)
 }
@@ -239,9 +251,7 @@ hello:
 				Text: "hello",
 			},
 			Recipe: []Node{
-				&Raw{
-					Text: "world",
-				},
+				&RecipeLine{Cmd: &Raw{Text: "world"}},
 			},
 		},
 	}, n)
@@ -280,9 +290,7 @@ $(ARG)-test:
 			},
 		},
 		Recipe: []Node{
-			&Raw{
-				Text: "echo",
-			},
+			&RecipeLine{Cmd: &Raw{Text: "echo"}},
 		},
 	}, n)
 }
@@ -315,6 +323,46 @@ endef
 	}, n)
 }
 
+func TestParseDefine(t *testing.T) {
+	n := parse(t, `
+define A :=
+a
+endef
+override export define B +=
+b
+endef
+define TEMPLATE
+define $(1)_R
+	endef
+$(1)
+  endef
+endef
+define EMPTY
+endef
+`)
+	assert.Equal(t, Nodes{
+		&Define{
+			Name: "A",
+			Op:   ":=",
+			Body: "a",
+		},
+		&Define{
+			Name:     "B",
+			Op:       "+=",
+			Body:     "b",
+			Override: true,
+			Export:   true,
+		},
+		&Define{
+			Name: "TEMPLATE",
+			Body: "define $(1)_R\n\tendef\n$(1)\n  endef",
+		},
+		&Define{
+			Name: "EMPTY",
+		},
+	}, n)
+}
+
 func TestParseExpTrailingComma(t *testing.T) {
 	n := parse(t, `
 $(A $(B),)
@@ -339,12 +387,27 @@ $(A $(B),)
 }
 
 func TestParseNlInExp(t *testing.T) {
-	n := parse(t, `
+	// Like in the value of a variable, which is where a variable reference can span lines
+	p, err := NewParserExprString(`
 $(A
 $(B $(C),
 D,)
 )
 `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Walk(n, func(n Node) bool {
+		n.SetPos(lexer.Position{}, lexer.Position{})
+		return true
+	})
+
 	assert.Equal(t, &Exp{
 		Parts: []Node{
 			&Raw{
@@ -393,6 +456,21 @@ $1
 	}, n)
 }
 
+func TestParseAutomaticVars(t *testing.T) {
+	n := parse(t, `
+$@$<$^$+$?$*$|$% $$@
+`)
+	exp := func(name string) Node {
+		return &Exp{Parts: []Node{&Raw{Text: name}}}
+	}
+	assert.Equal(t, &Expr{
+		Parts: []Node{
+			exp("@"), exp("<"), exp("^"), exp("+"), exp("?"), exp("*"), exp("|"), exp("%"),
+			&Raw{Text: " $@"},
+		},
+	}, n)
+}
+
 func TestParsePatSubst(t *testing.T) {
 	n := parse(t, `
 $(foo:%.o=.c)
@@ -423,12 +501,756 @@ run:
 			Text: "run",
 		},
 		Recipe: []Node{
-			&Raw{
-				Text: "echo 1",
+			&RecipeLine{Cmd: &Raw{Text: "echo 1"}},
+			&RecipeLine{Cmd: &Raw{Text: "echo 2"}},
+		},
+	}, n)
+}
+
+func TestParseElse(t *testing.T) {
+	n := parse(t, `
+ifdef A
+A=1
+else ifneq (B,C)
+A=2
+else
+A=3
+endif
+`)
+
+	assert.Equal(t, &IfDef{
+		Expected: true,
+		Ident:    "A",
+		Body: []Node{
+			&Var{
+				Name:  &Raw{Text: "A"},
+				Op:    "=",
+				Value: "1",
 			},
-			&Raw{
-				Text: "echo 2",
+		},
+		Else: []Node{
+			&IfEq{
+				Expected: false,
+				Left:     &Raw{Text: "B"},
+				Right:    &Raw{Text: "C"},
+				Body: []Node{
+					&Var{
+						Name:  &Raw{Text: "A"},
+						Op:    "=",
+						Value: "2",
+					},
+				},
+				Else: []Node{
+					&Var{
+						Name:  &Raw{Text: "A"},
+						Op:    "=",
+						Value: "3",
+					},
+				},
+			},
+		},
+	}, n)
+}
+
+func TestParseIfeqWhitespace(t *testing.T) {
+	n := parse(t, `
+ifeq ( A ,  B )
+endif
+`)
+
+	assert.Equal(t, &IfEq{
+		Expected: true,
+		Left:     &Raw{Text: " A"},
+		Right:    &Raw{Text: "B "},
+		Body:     []Node{},
+	}, n)
+}
+
+func TestParseIfeqQuoted(t *testing.T) {
+	n := parse(t, `
+ifeq "a" "b"
+endif
+ifeq 'a' 'b'
+endif
+ifeq "a" 'b'
+endif
+ifneq	' a,( '  " $(B) "
+endif
+ifeq (a,b) 
+endif
+ifeq "a" "b"	# comment
+endif
+`)
+
+	ab := &IfEq{
+		Expected: true,
+		Left:     &Raw{Text: "a"},
+		Right:    &Raw{Text: "b"},
+		Body:     []Node{},
+	}
+	assert.Equal(t, Nodes{
+		ab,
+		ab,
+		ab,
+		&IfEq{
+			Expected: false,
+			Left:     &Raw{Text: " a,( "},
+			Right:    &Expr{Parts: []Node{&Raw{Text: " "}, &Exp{Parts: []Node{&Raw{Text: "B"}}}, &Raw{Text: " "}}},
+			Body:     []Node{},
+		},
+		ab,
+		ab,
+	}, n)
+
+	p, err := NewParserString("ifeq (a,b) c\nendif\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Parse()
+	assert.EqualError(t, err, "[root > ifeq]: extraneous text after 'ifeq' directive")
+}
+
+func TestParsePositions(t *testing.T) {
+	n := parsePos(t, `
+A := 1
+target: $(A) dep
+	echo é $@
+`)
+
+	pos := func(offset, line, column int) lexer.Position {
+		return lexer.Position{Filename: "Makefile", Offset: offset, Line: line, Column: column}
+	}
+
+	nodes := n.(Nodes)
+
+	v := nodes[0].(*Var)
+	assert.Equal(t, Span{Start: pos(1, 2, 1), End: pos(7, 2, 7)}, v.Pos())
+	assert.Equal(t, Span{Start: pos(1, 2, 1), End: pos(3, 2, 3)}, v.Name.Pos())
+
+	target := nodes[1].(*Target)
+	assert.Equal(t, Span{Start: pos(8, 3, 1), End: pos(36, 4, 11)}, target.Pos())
+	assert.Equal(t, Span{Start: pos(8, 3, 1), End: pos(14, 3, 7)}, target.Name.Pos())
+
+	deps := target.Deps.(*Expr)
+	assert.Equal(t, Span{Start: pos(16, 3, 9), End: pos(24, 3, 17)}, deps.Pos())
+	assert.Equal(t, Span{Start: pos(16, 3, 9), End: pos(20, 3, 13)}, deps.Parts[0].Pos())
+	assert.Equal(t, Span{Start: pos(18, 3, 11), End: pos(19, 3, 12)}, deps.Parts[0].(*Exp).Parts[0].Pos())
+
+	recipe := target.Recipe[0]
+	assert.Equal(t, Span{Start: pos(26, 4, 2), End: pos(36, 4, 11)}, recipe.Pos())
+}
+
+func TestParseVarBody(t *testing.T) {
+	p, err := NewParserFilename("Makefile", strings.NewReader(`
+A := $(B) x
+C =
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ParseVarBody = true
+
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pos := func(offset, line, column int) lexer.Position {
+		return lexer.Position{Filename: "Makefile", Offset: offset, Line: line, Column: column}
+	}
+
+	nodes := n.(Nodes)
+
+	a := nodes[0].(*Var)
+	assert.Equal(t, "$(B) x", a.Value)
+	assert.Equal(t, Span{Start: pos(6, 2, 6), End: pos(12, 2, 12)}, a.Body.Pos())
+	assert.Equal(t, Span{Start: pos(6, 2, 6), End: pos(10, 2, 10)}, a.Body.(*Expr).Parts[0].Pos())
+
+	c := nodes[1].(*Var)
+	assert.Equal(t, Span{Start: pos(16, 3, 4), End: pos(16, 3, 4)}, c.Body.Pos())
+
+	Walk(n, func(n Node) bool {
+		n.SetPos(lexer.Position{}, lexer.Position{})
+		return true
+	})
+	assert.Equal(t, Nodes{
+		&Var{
+			Name:  &Raw{Text: "A"},
+			Op:    ":=",
+			Value: "$(B) x",
+			Body:  &Expr{Parts: []Node{&Exp{Parts: []Node{&Raw{Text: "B"}}}, &Raw{Text: " x"}}},
+		},
+		&Var{
+			Name: &Raw{Text: "C"},
+			Op:   "=",
+			Body: &Raw{},
+		},
+	}, n)
+}
+
+func TestParseRecover(t *testing.T) {
+	p, err := NewParserFilename("Makefile", strings.NewReader(`
+A=1
+endif
+ifdef B
+C=2
+endef
+D=3
+endif
+E=$(F
+$(G
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, diags := p.ParseRecover()
+
+	Walk(n, func(n Node) bool {
+		n.SetPos(lexer.Position{}, lexer.Position{})
+		return true
+	})
+
+	assert.Equal(t, Nodes{
+		&Var{
+			Name:  &Raw{Text: "A"},
+			Op:    "=",
+			Value: "1",
+		},
+		&IfDef{
+			Expected: true,
+			Ident:    "B",
+			Body: []Node{
+				&Var{
+					Name:  &Raw{Text: "C"},
+					Op:    "=",
+					Value: "2",
+				},
+				&Var{
+					Name:  &Raw{Text: "D"},
+					Op:    "=",
+					Value: "3",
+				},
+			},
+		},
+		&Var{
+			Name:  &Raw{Text: "E"},
+			Op:    "=",
+			Value: "$(F",
+		},
+		// The reference is closed at the end of the line
+		&Exp{Parts: []Node{&Raw{Text: "G"}}},
+	}, n)
+
+	assert.True(t, diags.HasErrors())
+
+	assert.Len(t, diags, 3)
+	for _, d := range diags {
+		assert.Equal(t, SeverityError, d.Severity)
+	}
+	assert.Equal(t, 3, diags[0].Pos.Line)
+	assert.Equal(t, []string{"root"}, diags[0].Trace)
+	assert.Equal(t, 6, diags[1].Pos.Line)
+	assert.Equal(t, []string{"root"}, diags[1].Trace)
+	assert.Equal(t, 10, diags[2].Pos.Line)
+	assert.Equal(t, "unterminated variable reference", diags[2].Message)
+}
+
+func TestParseRecoverUnterminated(t *testing.T) {
+	testCases := []struct {
+		src   string
+		nodes Nodes
+		lines []int
+	}{
+		{
+			"A := $(foo\nB := 1\nC := $(bar\nD := 2\n",
+			Nodes{
+				&Var{Name: &Raw{Text: "A"}, Op: ":=", Value: "$(foo"},
+				&Var{Name: &Raw{Text: "B"}, Op: ":=", Value: "1"},
+				&Var{Name: &Raw{Text: "C"}, Op: ":=", Value: "$(bar"},
+				&Var{Name: &Raw{Text: "D"}, Op: ":=", Value: "2"},
+			},
+			[]int{1, 3},
+		},
+		{
+			"ifdef A\nX := $(\nY := 1\nendif\nZ := ${a (b\n",
+			Nodes{
+				&IfDef{
+					Expected: true,
+					Ident:    "A",
+					Body: []Node{
+						&Var{Name: &Raw{Text: "X"}, Op: ":=", Value: "$("},
+						&Var{Name: &Raw{Text: "Y"}, Op: ":=", Value: "1"},
+					},
+				},
+				&Var{Name: &Raw{Text: "Z"}, Op: ":=", Value: "${a (b"},
+			},
+			[]int{2, 5},
+		},
+		{
+			"a: b\n\techo $(\nc: $(d $(e\n",
+			Nodes{
+				&Target{
+					Name:   &Raw{Text: "a"},
+					Deps:   &Raw{Text: "b"},
+					Recipe: []Node{&RecipeLine{Cmd: &Expr{Parts: []Node{&Raw{Text: "echo "}, &Exp{}}}}},
+				},
+				&Target{
+					Name:   &Raw{Text: "c"},
+					Deps:   &Exp{Parts: []Node{&Raw{Text: "d"}, &Exp{Parts: []Node{&Raw{Text: "e"}}}}},
+					Recipe: []Node{},
+				},
+			},
+			[]int{2, 3},
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewParserFilename("Makefile", strings.NewReader(tc.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, diags := p.ParseRecover()
+
+		Walk(n, func(n Node) bool {
+			n.SetPos(lexer.Position{}, lexer.Position{})
+			return true
+		})
+
+		assert.Equal(t, tc.nodes, n, tc.src)
+
+		lines := make([]int, 0, len(diags))
+		for _, d := range diags {
+			assert.Equal(t, "unterminated variable reference", d.Message, tc.src)
+			lines = append(lines, d.Pos.Line)
+		}
+		assert.Equal(t, tc.lines, lines, tc.src)
+	}
+}
+
+func TestParseRecoverConditionals(t *testing.T) {
+	testCases := []struct {
+		src   string
+		nodes Nodes
+		lines []int
+	}{
+		{
+			"ifdef A\nB := 1\nelse\nC := 2\nelse\nD := 3\nendif\nE := 4\n",
+			Nodes{
+				&IfDef{
+					Expected: true,
+					Ident:    "A",
+					Body:     []Node{&Var{Name: &Raw{Text: "B"}, Op: ":=", Value: "1"}},
+					Else: []Node{
+						&Var{Name: &Raw{Text: "C"}, Op: ":=", Value: "2"},
+						&Var{Name: &Raw{Text: "D"}, Op: ":=", Value: "3"},
+					},
+				},
+				&Var{Name: &Raw{Text: "E"}, Op: ":=", Value: "4"},
+			},
+			[]int{5},
+		},
+		{
+			"ifeq x\nA := 1\nendif\nifneq (a,b) c\nB := 2\nendif\nifdef\nC := 3\nendif\n",
+			Nodes{
+				&IfEq{
+					Expected: true,
+					Left:     &Raw{},
+					Right:    &Raw{},
+					Body:     []Node{&Var{Name: &Raw{Text: "A"}, Op: ":=", Value: "1"}},
+				},
+				&IfEq{
+					Left:  &Raw{Text: "a"},
+					Right: &Raw{Text: "b"},
+					Body:  []Node{&Var{Name: &Raw{Text: "B"}, Op: ":=", Value: "2"}},
+				},
+				&IfDef{
+					Expected: true,
+					Body:     []Node{&Var{Name: &Raw{Text: "C"}, Op: ":=", Value: "3"}},
+				},
+			},
+			[]int{1, 4, 7},
+		},
+		{
+			"ifdef A\nB := 1\n",
+			Nodes{
+				&IfDef{
+					Expected: true,
+					Ident:    "A",
+					Body:     []Node{&Var{Name: &Raw{Text: "B"}, Op: ":=", Value: "1"}},
+				},
+			},
+			[]int{3},
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewParserFilename("Makefile", strings.NewReader(tc.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, diags := p.ParseRecover()
+
+		Walk(n, func(n Node) bool {
+			n.SetPos(lexer.Position{}, lexer.Position{})
+			return true
+		})
+
+		if len(tc.nodes) == 1 {
+			assert.Equal(t, tc.nodes[0], n, tc.src)
+		} else {
+			assert.Equal(t, tc.nodes, n, tc.src)
+		}
+
+		lines := make([]int, 0, len(diags))
+		for _, d := range diags {
+			lines = append(lines, d.Pos.Line)
+		}
+		assert.Equal(t, tc.lines, lines, tc.src)
+	}
+}
+
+func TestParseTargetVar(t *testing.T) {
+	n := parse(t, `
+foo bar: CFLAGS += -O2
+%.o: private LDFLAGS =
+build/%: override export GOOS=linux
+`)
+	assert.Equal(t, Nodes{
+		&TargetVar{
+			Targets: &Raw{Text: "foo bar"},
+			Var: &Var{
+				Name:  &Raw{Text: "CFLAGS"},
+				Op:    "+=",
+				Value: "-O2",
+			},
+		},
+		&TargetVar{
+			Targets: &Raw{Text: "%.o"},
+			Private: true,
+			Var: &Var{
+				Name:  &Raw{Text: "LDFLAGS"},
+				Op:    "=",
+				Value: "",
+			},
+		},
+		&TargetVar{
+			Targets:  &Raw{Text: "build/%"},
+			Override: true,
+			Export:   true,
+			Var: &Var{
+				Name:  &Raw{Text: "GOOS"},
+				Op:    "=",
+				Value: "linux",
+			},
+		},
+	}, n)
+}
+
+func TestParseOrderOnly(t *testing.T) {
+	n := parse(t, `
+a: b c | d $(E)
+$(OBJS): %.o: %.c | dir
+`)
+	assert.Equal(t, Nodes{
+		&Target{
+			Name:      &Raw{Text: "a"},
+			Deps:      &Raw{Text: "b c"},
+			OrderOnly: &Expr{Parts: []Node{&Raw{Text: "d "}, &Exp{Parts: []Node{&Raw{Text: "E"}}}}},
+			Recipe:    []Node{},
+		},
+		&StaticPatternTarget{
+			Names:     &Exp{Parts: []Node{&Raw{Text: "OBJS"}}},
+			Targets:   &Raw{Text: "%.o"},
+			Prereqs:   &Raw{Text: "%.c"},
+			OrderOnly: &Raw{Text: "dir"},
+			Recipe:    []Node{},
+		},
+	}, n)
+}
+
+func TestParseDoubleColon(t *testing.T) {
+	n := parse(t, `
+a:: b
+	echo
+A::=1
+`)
+	assert.Equal(t, Nodes{
+		&Target{
+			Name:        &Raw{Text: "a"},
+			Deps:        &Raw{Text: "b"},
+			DoubleColon: true,
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{Text: "echo"}},
+			},
+		},
+		&Var{
+			Name:  &Raw{Text: "A"},
+			Op:    "::=",
+			Value: "1",
+		},
+	}, n)
+}
+
+func TestParseGroupedTargets(t *testing.T) {
+	n := parse(t, `
+a.pb.go a_grpc.pb.go &: a.proto
+	protoc a.proto
+`)
+	assert.Equal(t, &Target{
+		Name:    &Raw{Text: "a.pb.go a_grpc.pb.go "},
+		Deps:    &Raw{Text: "a.proto"},
+		Grouped: true,
+		Recipe: []Node{
+			&RecipeLine{Cmd: &Raw{Text: "protoc a.proto"}},
+		},
+	}, n)
+}
+
+func TestParseInlineRecipe(t *testing.T) {
+	n := parse(t, `
+a: dep ; echo hi
+	echo there
+$(OBJS): %.o: %.c ;cc $(CFLAGS)
+b: ;
+`)
+	assert.Equal(t, Nodes{
+		&Target{
+			Name: &Raw{Text: "a"},
+			Deps: &Raw{Text: "dep"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{Text: "echo hi"}},
+				&RecipeLine{Cmd: &Raw{Text: "echo there"}},
+			},
+		},
+		&StaticPatternTarget{
+			Names:   &Exp{Parts: []Node{&Raw{Text: "OBJS"}}},
+			Targets: &Raw{Text: "%.o"},
+			Prereqs: &Raw{Text: "%.c"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Expr{Parts: []Node{&Raw{Text: "cc "}, &Exp{Parts: []Node{&Raw{Text: "CFLAGS"}}}}}},
+			},
+		},
+		&Target{
+			Name: &Raw{Text: "b"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{}},
+			},
+		},
+	}, n)
+}
+
+func TestParseRecipeFlags(t *testing.T) {
+	n := parse(t, `
+a: ; @echo inline
+	@echo silent
+	-rm -f a
+	+$(MAKE) -C b
+	 @- + echo all
+	@
+	@$(Q)echo
+`)
+	assert.Equal(t, &Target{
+		Name: &Raw{Text: "a"},
+		Recipe: []Node{
+			&RecipeLine{Silent: true, Cmd: &Raw{Text: "echo inline"}},
+			&RecipeLine{Silent: true, Cmd: &Raw{Text: "echo silent"}},
+			&RecipeLine{IgnoreErrors: true, Cmd: &Raw{Text: "rm -f a"}},
+			&RecipeLine{Always: true, Cmd: &Expr{Parts: []Node{&Exp{Parts: []Node{&Raw{Text: "MAKE"}}}, &Raw{Text: " -C b"}}}},
+			&RecipeLine{Silent: true, IgnoreErrors: true, Always: true, Cmd: &Raw{Text: "echo all"}},
+			&RecipeLine{Silent: true, Cmd: &Raw{}},
+			&RecipeLine{Silent: true, Cmd: &Expr{Parts: []Node{&Exp{Parts: []Node{&Raw{Text: "Q"}}}, &Raw{Text: "echo"}}}},
+		},
+	}, n)
+
+	n = parsePos(t, "a:\n\t  @echo\n")
+	line := n.(*Target).Recipe[0].(*RecipeLine)
+	assert.Equal(t, 6, line.Pos().Start.Offset)
+	assert.Equal(t, 11, line.Pos().End.Offset)
+	assert.Equal(t, 7, line.Cmd.Pos().Start.Offset)
+}
+
+func TestParseRecipePrefix(t *testing.T) {
+	n := parse(t, `
+.RECIPEPREFIX = >
+a:
+>echo a
+.RECIPEPREFIX =
+c:
+	echo c
+`)
+	assert.Equal(t, Nodes{
+		&Var{
+			Name:  &Raw{Text: ".RECIPEPREFIX"},
+			Op:    "=",
+			Value: ">",
+		},
+		&Target{
+			Name: &Raw{Text: "a"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{Text: "echo a"}},
+			},
+		},
+		&Var{
+			Name:  &Raw{Text: ".RECIPEPREFIX"},
+			Op:    "=",
+			Value: "",
+		},
+		&Target{
+			Name: &Raw{Text: "c"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{Text: "echo c"}},
+			},
+		},
+	}, n)
+}
+
+func TestParseKeywordContext(t *testing.T) {
+	n := parse(t, `
+include_dirs := a
+my_define = $(call endif_helper)
+  -include a.mk
+sinclude b.mk
+ifdef X
+else ifeq (a,b)
+endif
+a: include
+`)
+	assert.Equal(t, Nodes{
+		&Var{
+			Name:  &Raw{Text: "include_dirs"},
+			Op:    ":=",
+			Value: "a",
+		},
+		&Var{
+			Name:  &Raw{Text: "my_define"},
+			Op:    "=",
+			Value: "$(call endif_helper)",
+		},
+		&Modifier{
+			Modifier: "-",
+			Node: &Include{
+				Path: &Raw{Text: "a.mk"},
 			},
 		},
+		&Modifier{
+			Modifier: "-",
+			Node: &Include{
+				Path: &Raw{Text: "b.mk"},
+			},
+		},
+		&IfDef{
+			Expected: true,
+			Ident:    "X",
+			Body:     []Node{},
+			Else: []Node{
+				&IfEq{
+					Expected: true,
+					Left:     &Raw{Text: "a"},
+					Right:    &Raw{Text: "b"},
+					Body:     []Node{},
+				},
+			},
+		},
+		&Target{
+			Name:   &Raw{Text: "a"},
+			Deps:   &Raw{Text: "include"},
+			Recipe: []Node{},
+		},
+	}, n)
+}
+
+func TestParseEscapes(t *testing.T) {
+	n := parse(t, `
+a: $$x \#y
+	echo $$x \# # kept
+`)
+	assert.Equal(t, &Target{
+		Name: &Raw{Text: "a"},
+		Deps: &Raw{Text: "$x #y"},
+		Recipe: []Node{
+			&RecipeLine{Cmd: &Raw{Text: "echo $x \\# # kept"}},
+		},
+	}, n)
+}
+
+func TestParseContinuations(t *testing.T) {
+	n := parse(t, `
+A = a   \
+    b
+a: b \
+  c
+	echo a \
+	  b
+# comment \
+  continued
+`)
+	assert.Equal(t, Nodes{
+		&Var{
+			Name:  &Raw{Text: "A"},
+			Op:    "=",
+			Value: "a b",
+		},
+		&Target{
+			Name: &Raw{Text: "a"},
+			Deps: &Raw{Text: "b c"},
+			Recipe: []Node{
+				&RecipeLine{Cmd: &Raw{Text: "echo a \\\n  b"}},
+			},
+		},
+	}, n)
+}
+
+func TestParseCRLF(t *testing.T) {
+	lf := `
+A = a \
+  b
+# comment
+define D
+d
+endef
+été: $(subst a,b,\
+c)
+	echo a \
+	b
+`
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+
+	assert.Equal(t, parse(t, lf), parse(t, crlf))
+
+	n := parsePos(t, crlf)
+	target := n.(Nodes)[2].(*Target)
+	assert.Equal(t, lexer.Position{Filename: "Makefile", Offset: 54, Line: 8, Column: 6}, target.Deps.Pos().Start)
+}
+
+func TestParseMixedLineEndings(t *testing.T) {
+	p, err := NewParserFilename("Makefile", strings.NewReader("A = 1\nB = 2\r\nC = 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.WarnMixedLineEndings = true
+
+	_, diags := p.ParseRecover()
+	assert.Equal(t, Diagnostics{
+		{
+			Pos:      lexer.Position{Filename: "Makefile", Offset: 11, Line: 2, Column: 6},
+			Severity: SeverityWarning,
+			Message:  "mixed line endings, CRLF here but LF on line 1",
+		},
+	}, diags)
+	assert.False(t, diags.HasErrors())
+}
+
+func TestParseParens(t *testing.T) {
+	n := parse(t, `$(subst (a,b),${x},{c,d})`)
+	assert.Equal(t, &Exp{
+		Parts: []Node{
+			&Raw{Text: "subst"},
+			&Raw{Text: "(a,b)"},
+			&Exp{Parts: []Node{&Raw{Text: "x"}}},
+			&Raw{Text: "{c"},
+			&Raw{Text: "d}"},
+		},
 	}, n)
 }
@@ -2,15 +2,21 @@ package parser
 
 import (
 	"errors"
+	"mxplrr/lexer"
 	"strings"
 )
 
 type traceErr struct {
 	trace []string
+	pos   lexer.Position
 	err   error
 }
 
 func (e *traceErr) Error() string {
+	if len(e.trace) == 0 {
+		return e.err.Error()
+	}
+
 	prefix := strings.Join(e.trace, " > ")
 
 	return "[" + prefix + "]: " + e.err.Error()
@@ -26,8 +32,8 @@ func (e *traceErr) Unwrap() error {
 }
 
 func Wrap(name string, err error) error {
-	if errors.Is(err, &traceErr{}) {
-		we := err.(*traceErr)
+	var we *traceErr
+	if errors.As(err, &we) {
 		we.trace = append([]string{name}, we.trace...)
 		return we
 	} else {
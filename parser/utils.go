@@ -25,11 +25,17 @@ func (p *Parser) peekn(i int) lexer.Token {
 
 func (p *Parser) errat(t lexer.Token, f string, arg ...interface{}) error {
 	args := append(arg, t.String())
-	return p.err(f+" at %v", args...)
+	return &traceErr{
+		pos: t.Pos,
+		err: fmt.Errorf(f+" at %v", args...),
+	}
 }
 
 func (p *Parser) err(f string, args ...interface{}) error {
-	return fmt.Errorf(f, args...)
+	return &traceErr{
+		pos: p.peekn(0).Pos,
+		err: fmt.Errorf(f, args...),
+	}
 }
 
 // Unhandled token
@@ -43,7 +49,14 @@ func (p *Parser) wrap(name string, err error) error {
 
 func (p *Parser) expect(matcher lexer.Matcher) (lexer.Token, error) {
 	t := p.advance()
-	return t, matcher.Validate(t)
+	if err := matcher.Validate(t); err != nil {
+		return t, &traceErr{
+			pos: t.Pos,
+			err: err,
+		}
+	}
+
+	return t, nil
 }
 
 func (p *Parser) eat(matcher lexer.Matcher) bool {
@@ -65,3 +78,71 @@ func (p *Parser) eatall(matcher lexer.Matcher) bool {
 
 	return false
 }
+
+func (p *Parser) tokenAt(i int) lexer.Token {
+	if i > len(p.tokens)-1 {
+		if len(p.tokens) == 0 {
+			return lexer.NilToken
+		}
+		return p.tokens[len(p.tokens)-1]
+	}
+
+	return p.tokens[i]
+}
+
+// span sets the position of n, from the token at index start to the last consumed token,
+// not including trailing new lines
+func (p *Parser) span(n Node, start int) {
+	if n == nil {
+		return
+	}
+
+	startPos := p.tokenAt(start).Pos
+
+	last := p.c - 1
+	for last >= start && NlMatcher.Is(p.tokens[last]) {
+		last--
+	}
+
+	endPos := startPos
+	if last >= start {
+		endPos = p.tokens[last].End()
+	}
+
+	n.SetPos(startPos, endPos)
+}
+
+// report records err as a diagnostic
+func (p *Parser) report(err error) {
+	p.diagnostics = append(p.diagnostics, newDiagnostic(err, p.peekn(0).Pos))
+}
+
+// sync skips tokens up to the end of the current line, so that parsing can resume after an error
+func (p *Parser) sync() {
+	for {
+		t := p.peekn(0)
+		if isEOF(t) {
+			return
+		}
+
+		p.advance()
+
+		if NlMatcher.Is(t) {
+			return
+		}
+	}
+}
+
+// recoverLine returns err, or when recovering, reports it as an error of the rule name
+// and resumes parsing at the line following the token at index i
+func (p *Parser) recoverLine(name string, err error, i int) error {
+	if !p.recovering {
+		return err
+	}
+
+	p.report(p.wrap(name, err))
+	p.c = i
+	p.sync()
+
+	return nil
+}
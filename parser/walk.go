@@ -0,0 +1,63 @@
+package parser
+
+// Walk traverses the tree rooted at n in depth-first order, calling f for each node.
+// If f returns false, the children of the node are not visited.
+func Walk(n Node, f func(n Node) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+
+	walkList := func(nodes []Node) {
+		for _, c := range nodes {
+			Walk(c, f)
+		}
+	}
+
+	switch n := n.(type) {
+	case Nodes:
+		walkList(n)
+	case *File:
+		Walk(n.Nodes, f)
+	case *Target:
+		Walk(n.Name, f)
+		Walk(n.Deps, f)
+		Walk(n.OrderOnly, f)
+		walkList(n.Recipe)
+	case *RecipeLine:
+		Walk(n.Cmd, f)
+	case *TargetVar:
+		Walk(n.Targets, f)
+		if n.Var != nil {
+			Walk(n.Var, f)
+		}
+	case *StaticPatternTarget:
+		Walk(n.Names, f)
+		Walk(n.Targets, f)
+		Walk(n.Prereqs, f)
+		Walk(n.OrderOnly, f)
+		walkList(n.Recipe)
+	case *Expr:
+		walkList(n.Parts)
+	case *Exp:
+		walkList(n.Parts)
+	case *Var:
+		Walk(n.Name, f)
+		Walk(n.Body, f)
+	case *PatSubst:
+		Walk(n.Name, f)
+		Walk(n.Pattern, f)
+		Walk(n.Subst, f)
+	case *Include:
+		Walk(n.Path, f)
+	case *IfEq:
+		Walk(n.Left, f)
+		Walk(n.Right, f)
+		walkList(n.Body)
+		walkList(n.Else)
+	case *IfDef:
+		walkList(n.Body)
+		walkList(n.Else)
+	case *Modifier:
+		Walk(n.Node, f)
+	}
+}
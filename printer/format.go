@@ -0,0 +1,293 @@
+package printer
+
+import (
+	"bytes"
+	"errors"
+	"mxplrr/parser"
+	"sort"
+	"unicode/utf8"
+)
+
+// Format returns the canonical formatting of f: consecutive assignments are aligned,
+// directives are followed by a single space and recipe lines start with a single tab.
+// Everything else is kept as it is in the source.
+func Format(f *parser.File) ([]byte, error) {
+	if f.Source == nil {
+		return nil, errors.New("file has no source")
+	}
+
+	fm := &formatter{src: f.Source}
+	fm.list(nodes(f.Nodes))
+
+	return fm.apply(), nil
+}
+
+type edit struct {
+	start, end int
+	text       string
+}
+
+type formatter struct {
+	src   []byte
+	edits []edit
+}
+
+func nodes(n parser.Node) []parser.Node {
+	switch n := n.(type) {
+	case nil:
+		return nil
+	case parser.Nodes:
+		return n
+	}
+
+	return []parser.Node{n}
+}
+
+func (f *formatter) replace(start, end int, text string) {
+	if string(f.src[start:end]) == text {
+		return
+	}
+
+	f.edits = append(f.edits, edit{start: start, end: end, text: text})
+}
+
+func (f *formatter) apply() []byte {
+	sort.SliceStable(f.edits, func(i, j int) bool {
+		return f.edits[i].start < f.edits[j].start
+	})
+
+	var buf bytes.Buffer
+	last := 0
+	for _, e := range f.edits {
+		if e.start < last {
+			// Overlapping edit, keep the source as is
+			continue
+		}
+
+		buf.Write(f.src[last:e.start])
+		buf.WriteString(e.text)
+		last = e.end
+	}
+	buf.Write(f.src[last:])
+
+	return buf.Bytes()
+}
+
+func (f *formatter) list(ns []parser.Node) {
+	var group []*parser.Var
+	for _, n := range ns {
+		if v, ok := n.(*parser.Var); ok {
+			if len(group) > 0 && group[len(group)-1].Pos().End.Line+1 != v.Pos().Start.Line {
+				f.assignments(group)
+				group = nil
+			}
+
+			group = append(group, v)
+			continue
+		}
+
+		f.assignments(group)
+		group = nil
+
+		f.node(n)
+	}
+	f.assignments(group)
+}
+
+func (f *formatter) valid(n parser.Node) bool {
+	_, ok := source(f.src, n)
+	return ok
+}
+
+func (f *formatter) node(n parser.Node) {
+	if !f.valid(n) {
+		return
+	}
+
+	switch n := n.(type) {
+	case *parser.Modifier:
+		f.node(n.Node)
+	case *parser.Include:
+		f.keyword(n.Pos().Start.Offset)
+	case *parser.Define:
+		offset := n.Pos().Start.Offset
+		if n.Override {
+			offset = f.keyword(offset)
+		}
+		if n.Export {
+			offset = f.keyword(offset)
+		}
+		f.keyword(offset)
+	case *parser.IfEq, *parser.IfDef:
+		f.cond(n)
+	case *parser.Target:
+		f.recipe(n.Recipe)
+	case *parser.StaticPatternTarget:
+		f.recipe(n.Recipe)
+	}
+}
+
+// keyword makes sure the directive starting at offset is followed by a single space,
+// returning the offset of the word that follows it
+func (f *formatter) keyword(offset int) int {
+	i := offset
+	for i < len(f.src) && f.src[i] >= 'a' && f.src[i] <= 'z' {
+		i++
+	}
+
+	j := i
+	for j < len(f.src) && isBlank(f.src[j]) {
+		j++
+	}
+
+	if j == len(f.src) || f.src[j] == '\n' || f.src[j] == '\r' || f.src[j] == '#' {
+		return j
+	}
+
+	f.replace(i, j, " ")
+
+	return j
+}
+
+func (f *formatter) cond(n parser.Node) {
+	var body, els []parser.Node
+	switch n := n.(type) {
+	case *parser.IfEq:
+		body, els = n.Body, n.Else
+	case *parser.IfDef:
+		body, els = n.Body, n.Else
+	}
+
+	f.keyword(n.Pos().Start.Offset)
+	f.list(body)
+
+	if els == nil {
+		return
+	}
+
+	// Look for the else line between the body and the else branch
+	from := f.lineEnd(n.Pos().Start.Offset)
+	if len(body) > 0 && body[len(body)-1].Pos().End.Offset > from {
+		from = body[len(body)-1].Pos().End.Offset
+	}
+	to := n.Pos().End.Offset
+	if len(els) > 0 {
+		to = els[0].Pos().Start.Offset
+	}
+
+	for i := from; i < to; i = f.lineEnd(i) + 1 {
+		j := i
+		for j < to && isBlank(f.src[j]) {
+			j++
+		}
+
+		if bytes.HasPrefix(f.src[j:to], []byte("else")) {
+			f.keyword(j)
+			break
+		}
+	}
+
+	if len(els) == 1 {
+		switch els[0].(type) {
+		case *parser.IfEq, *parser.IfDef:
+			f.cond(els[0])
+			return
+		}
+	}
+
+	f.list(els)
+}
+
+func (f *formatter) recipe(cmds []parser.Node) {
+	for _, cmd := range cmds {
+		if !f.valid(cmd) {
+			continue
+		}
+
+		start := f.lineStart(cmd.Pos().Start.Offset)
+		end := start
+		for end < len(f.src) && isBlank(f.src[end]) {
+			end++
+		}
+		if end < cmd.Pos().Start.Offset {
+			// Inline recipe, following the `;` on the rule line
+			continue
+		}
+
+		f.replace(start, end, "\t")
+	}
+}
+
+// assignments aligns the operators of a group of consecutive variable assignments
+func (f *formatter) assignments(group []*parser.Var) {
+	type assignment struct {
+		nameEnd, valueStart, valueEnd int
+		width                         int
+		op                            string
+	}
+
+	as := make([]assignment, 0, len(group))
+	width := 0
+	for _, v := range group {
+		if !f.valid(v) || !f.valid(v.Name) {
+			continue
+		}
+
+		nameEnd := v.Name.Pos().End.Offset
+		for nameEnd > v.Name.Pos().Start.Offset && isBlank(f.src[nameEnd-1]) {
+			nameEnd--
+		}
+
+		opStart := nameEnd
+		for opStart < len(f.src) && isBlank(f.src[opStart]) {
+			opStart++
+		}
+		if !bytes.HasPrefix(f.src[opStart:], []byte(v.Op)) {
+			continue
+		}
+
+		valueStart := opStart + len(v.Op)
+		for valueStart < v.Pos().End.Offset && isBlank(f.src[valueStart]) {
+			valueStart++
+		}
+
+		a := assignment{
+			nameEnd:    nameEnd,
+			valueStart: valueStart,
+			valueEnd:   v.Pos().End.Offset,
+			width:      utf8.RuneCount(f.src[v.Pos().Start.Offset:nameEnd]),
+			op:         v.Op,
+		}
+		if a.width > width {
+			width = a.width
+		}
+
+		as = append(as, a)
+	}
+
+	for _, a := range as {
+		text := string(bytes.Repeat([]byte(" "), width-a.width)) + " " + a.op
+		if a.valueStart < a.valueEnd {
+			text += " "
+		}
+
+		f.replace(a.nameEnd, a.valueStart, text)
+	}
+}
+
+func (f *formatter) lineStart(offset int) int {
+	return bytes.LastIndexByte(f.src[:offset], '\n') + 1
+}
+
+func (f *formatter) lineEnd(offset int) int {
+	i := bytes.IndexByte(f.src[offset:], '\n')
+	if i < 0 {
+		return len(f.src)
+	}
+
+	return offset + i
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
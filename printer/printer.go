@@ -0,0 +1,391 @@
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mxplrr/parser"
+	"strings"
+)
+
+// Fprint writes the Makefile text of n to w.
+// Nodes that were parsed from src are printed exactly as they appear in it, by slicing src.
+// Other nodes are printed from their fields, which do not keep the whitespace, the trailing
+// comments or the continuations outside of recipes: only the comments set on a node are printed,
+// on the lines preceding it, and the spacing is normalized.
+func Fprint(w io.Writer, src []byte, n parser.Node) error {
+	p := &printer{src: src}
+
+	err := p.node(n)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(p.buf.Bytes())
+	return err
+}
+
+// Sprint is like Fprint, but returns the text
+func Sprint(src []byte, n parser.Node) (string, error) {
+	var buf bytes.Buffer
+
+	err := Fprint(&buf, src, n)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+type printer struct {
+	src      []byte
+	buf      bytes.Buffer
+	inRecipe bool
+}
+
+func (p *printer) print(ss ...string) {
+	for _, s := range ss {
+		p.buf.WriteString(s)
+	}
+}
+
+// source returns the text n was parsed from, if any
+func (p *printer) source(n parser.Node) ([]byte, bool) {
+	return source(p.src, n)
+}
+
+func source(src []byte, n parser.Node) ([]byte, bool) {
+	if src == nil {
+		return nil, false
+	}
+
+	span := n.Pos()
+	if span.Start.Line == 0 || span.Start.Offset > span.End.Offset || span.End.Offset > len(src) {
+		return nil, false
+	}
+
+	return src[span.Start.Offset:span.End.Offset], true
+}
+
+func (p *printer) node(n parser.Node) error {
+	if n == nil {
+		return nil
+	}
+
+	if f, ok := n.(*parser.File); ok && f.Source != nil {
+		p.src = f.Source
+	}
+
+	if text, ok := p.source(n); ok {
+		p.buf.Write(text)
+		return nil
+	}
+
+	switch n := n.(type) {
+	case *parser.File:
+		return p.node(n.Nodes)
+	case parser.Nodes:
+		return p.lines(n)
+	case *parser.Raw:
+		p.print(p.escape(n.Text))
+	case *parser.Comment:
+		p.print(n.Text)
+	case *parser.Expr:
+		for _, part := range n.Parts {
+			if err := p.node(part); err != nil {
+				return err
+			}
+		}
+	case *parser.Exp:
+		p.print("$(")
+		for i, part := range n.Parts {
+			switch i {
+			case 0:
+			case 1:
+				p.print(" ")
+			default:
+				p.print(",")
+			}
+
+			if err := p.node(part); err != nil {
+				return err
+			}
+		}
+		p.print(")")
+	case *parser.PatSubst:
+		p.print("$(")
+		if err := p.node(n.Name); err != nil {
+			return err
+		}
+		p.print(":")
+		if err := p.node(n.Pattern); err != nil {
+			return err
+		}
+		p.print("=")
+		if err := p.node(n.Subst); err != nil {
+			return err
+		}
+		p.print(")")
+	case *parser.Var:
+		if err := p.node(n.Name); err != nil {
+			return err
+		}
+		p.print(" ", n.Op)
+		if n.Value != "" {
+			p.print(" ", n.Value)
+		}
+	case *parser.Include:
+		p.print("include ")
+		return p.node(n.Path)
+	case *parser.Modifier:
+		p.print(n.Modifier)
+		return p.node(n.Node)
+	case *parser.IfEq, *parser.IfDef:
+		if err := p.cond(n); err != nil {
+			return err
+		}
+		p.print("\nendif")
+	case *parser.Define:
+		if n.Override {
+			p.print("override ")
+		}
+		if n.Export {
+			p.print("export ")
+		}
+		p.print("define ", n.Name)
+		if n.Op != "" {
+			p.print(" ", n.Op)
+		}
+		p.print("\n")
+		if n.Body != "" {
+			p.print(n.Body, "\n")
+		}
+		p.print("endef")
+	case *parser.Target:
+		if err := p.node(n.Name); err != nil {
+			return err
+		}
+		if n.Grouped {
+			p.print("&")
+		}
+		p.print(":")
+		if n.DoubleColon {
+			p.print(":")
+		}
+		if n.Deps != nil {
+			p.print(" ")
+			if err := p.node(n.Deps); err != nil {
+				return err
+			}
+		}
+		if err := p.orderOnly(n.OrderOnly); err != nil {
+			return err
+		}
+		return p.recipe(n.Recipe)
+	case *parser.RecipeLine:
+		for _, flag := range []struct {
+			set  bool
+			text string
+		}{{n.Silent, "@"}, {n.IgnoreErrors, "-"}, {n.Always, "+"}} {
+			if flag.set {
+				p.print(flag.text)
+			}
+		}
+		return p.node(n.Cmd)
+	case *parser.TargetVar:
+		if err := p.node(n.Targets); err != nil {
+			return err
+		}
+		p.print(": ")
+		for _, prefix := range []struct {
+			set  bool
+			name string
+		}{{n.Override, "override"}, {n.Export, "export"}, {n.Private, "private"}} {
+			if prefix.set {
+				p.print(prefix.name, " ")
+			}
+		}
+		return p.node(n.Var)
+	case *parser.StaticPatternTarget:
+		if err := p.node(n.Names); err != nil {
+			return err
+		}
+		p.print(": ")
+		if err := p.node(n.Targets); err != nil {
+			return err
+		}
+		p.print(": ")
+		if err := p.node(n.Prereqs); err != nil {
+			return err
+		}
+		if err := p.orderOnly(n.OrderOnly); err != nil {
+			return err
+		}
+		return p.recipe(n.Recipe)
+	default:
+		return fmt.Errorf("cannot print %T", n)
+	}
+
+	return nil
+}
+
+func (p *printer) lines(nodes []parser.Node) error {
+	for i, n := range nodes {
+		if i > 0 {
+			p.print("\n")
+		}
+
+		if _, ok := p.source(n); !ok {
+			for _, c := range n.Comments() {
+				p.print(c, "\n")
+			}
+		}
+
+		if err := p.node(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cond prints a conditional and its else branches, without the closing endif
+func (p *printer) cond(n parser.Node) error {
+	var body, els []parser.Node
+	switch n := n.(type) {
+	case *parser.IfEq:
+		p.print(keyword(n.Expected, "ifeq", "ifneq"), " ")
+		if err := p.ifeqArgs(n); err != nil {
+			return err
+		}
+		body, els = n.Body, n.Else
+	case *parser.IfDef:
+		p.print(keyword(n.Expected, "ifdef", "ifndef"), " ", n.Ident)
+		body, els = n.Body, n.Else
+	}
+
+	if len(body) > 0 {
+		p.print("\n")
+		if err := p.lines(body); err != nil {
+			return err
+		}
+	}
+
+	if els == nil {
+		return nil
+	}
+
+	p.print("\nelse")
+
+	if len(els) == 1 {
+		switch els[0].(type) {
+		case *parser.IfEq, *parser.IfDef:
+			// The chained conditional shares the endif of its parent
+			p.print(" ")
+			return p.cond(els[0])
+		}
+	}
+
+	if len(els) > 0 {
+		p.print("\n")
+		return p.lines(els)
+	}
+
+	return nil
+}
+
+// ifeqArgs prints the arguments of n in the `(a,b)` form,
+// unless they only survive a round trip through the quoted `"a" "b"` form
+func (p *printer) ifeqArgs(n *parser.IfEq) error {
+	text := func(n parser.Node) (string, error) {
+		sub := &printer{src: p.src, inRecipe: p.inRecipe}
+		if err := sub.node(n); err != nil {
+			return "", err
+		}
+		return sub.buf.String(), nil
+	}
+
+	left, err := text(n.Left)
+	if err != nil {
+		return err
+	}
+	right, err := text(n.Right)
+	if err != nil {
+		return err
+	}
+
+	if !bareText(n.Left, ",()") && !bareText(n.Right, ",()") &&
+		strings.TrimRight(left, " \t") == left && strings.TrimLeft(right, " \t") == right {
+		p.print("(", left, ",", right, ")")
+		return nil
+	}
+
+	quote := func(s string) string {
+		if strings.Contains(s, `"`) {
+			return "'" + s + "'"
+		}
+		return `"` + s + `"`
+	}
+	p.print(quote(left), " ", quote(right))
+
+	return nil
+}
+
+// bareText reports whether the literal text of n, outside of any expansion, contains any of chars
+func bareText(n parser.Node, chars string) bool {
+	switch n := n.(type) {
+	case *parser.Raw:
+		return strings.ContainsAny(n.Text, chars)
+	case *parser.Expr:
+		for _, part := range n.Parts {
+			if bareText(part, chars) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *printer) orderOnly(n parser.Node) error {
+	if n == nil {
+		return nil
+	}
+
+	p.print(" | ")
+	return p.node(n)
+}
+
+// escape reverses the unescaping done by the parser on the text of expressions
+func (p *printer) escape(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	if !p.inRecipe {
+		s = strings.ReplaceAll(s, "#", "\\#")
+	}
+
+	return s
+}
+
+func (p *printer) recipe(cmds []parser.Node) error {
+	p.inRecipe = true
+	defer func() {
+		p.inRecipe = false
+	}()
+
+	for _, cmd := range cmds {
+		p.print("\n\t")
+		if err := p.node(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func keyword(expected bool, yes, no string) string {
+	if expected {
+		return yes
+	}
+
+	return no
+}
@@ -0,0 +1,273 @@
+package printer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"mxplrr/lexer"
+	"mxplrr/parser"
+	"testing"
+)
+
+func parse(t *testing.T, s string) *parser.File {
+	f, err := parser.ParseSource("Makefile", []byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestFprintLossless(t *testing.T) {
+	testCases := []string{
+		"",
+		"A=1",
+		"A   :=  1   # some comment\n\n\n# Another comment\nB ?= $(A) \\\n\t  more\n",
+		`
+# Comment
+ifeq  ($(A), 1)
+B = 2
+else ifneq "a"  'b'
+else  ifdef  C   # trailing
+B = 3
+else
+B = 4
+endif
+
+-include   $(wildcard *.mk)
+
+define   SOME
+line $(1)
+  indented
+endef
+
+target: dep1 \
+	dep2 # comment
+	@echo $@   
+	@ - +echo flags
+	# recipe comment
+	  echo $(call SOME,a)
+
+%.o: %.c: %.h
+	cc -o $@ $<
+`,
+	}
+	for _, tc := range testCases {
+		f := parse(t, tc)
+
+		out, err := Sprint(nil, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc, out)
+	}
+}
+
+func TestFprintNode(t *testing.T) {
+	f := parse(t, "A   :=  1   # some comment\nB=2\n")
+
+	out, err := Sprint(f.Source, f.Nodes.(parser.Nodes)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "A   :=  1   # some comment", out)
+}
+
+func TestFprintGenerated(t *testing.T) {
+	n := parser.Nodes{
+		&parser.Var{
+			Name:  &parser.Raw{Text: "A"},
+			Op:    ":=",
+			Value: "1",
+		},
+		&parser.IfDef{
+			Expected: false,
+			Ident:    "B",
+			Body: []parser.Node{
+				&parser.Modifier{
+					Modifier: "-",
+					Node: &parser.Include{
+						Path: &parser.Raw{Text: "b.mk"},
+					},
+				},
+			},
+			Else: []parser.Node{
+				&parser.IfEq{
+					Expected: true,
+					Left: &parser.Exp{
+						Parts: []parser.Node{&parser.Raw{Text: "B"}},
+					},
+					Right: &parser.Raw{Text: "1"},
+					Else: []parser.Node{
+						&parser.IfEq{
+							Expected: false,
+							Left:     &parser.Raw{Text: "a,b"},
+							Right:    &parser.Raw{Text: ` "c"`},
+						},
+					},
+				},
+			},
+		},
+		&parser.Target{
+			Name: &parser.Raw{Text: "all"},
+			Deps: &parser.Exp{
+				Parts: []parser.Node{
+					&parser.Raw{Text: "patsubst"},
+					&parser.Raw{Text: "%.c"},
+					&parser.Raw{Text: "%.o"},
+					&parser.PatSubst{
+						Name:    &parser.Raw{Text: "SRCS"},
+						Pattern: &parser.Raw{Text: ".x"},
+						Subst:   &parser.Raw{Text: ".c"},
+					},
+				},
+			},
+			Recipe: []parser.Node{
+				&parser.RecipeLine{Silent: true, Cmd: &parser.Raw{Text: "echo done"}},
+				&parser.RecipeLine{IgnoreErrors: true, Always: true, Cmd: &parser.Raw{Text: "rm -f x"}},
+			},
+		},
+		&parser.Target{
+			Name: &parser.Raw{Text: "$x"},
+			Deps: &parser.Raw{Text: "#y"},
+			Recipe: []parser.Node{
+				&parser.RecipeLine{Cmd: &parser.Raw{Text: "echo $x #"}},
+			},
+		},
+		&parser.Define{
+			Name:     "C",
+			Op:       ":=",
+			Body:     "c",
+			Override: true,
+		},
+	}
+
+	out, err := Sprint(nil, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `A := 1
+ifndef B
+-include b.mk
+else ifeq ($(B),1)
+else ifneq "a,b" ' "c"'
+endif
+all: $(patsubst %.c,%.o,$(SRCS:.x=.c))
+	@echo done
+	-+rm -f x
+$$x: \#y
+	echo $$x #
+override define C :=
+c
+endef`, out)
+}
+
+func TestFprintGeneratedRoundTrip(t *testing.T) {
+	target := &parser.Target{
+		Name: &parser.Raw{Text: "all"},
+		Deps: &parser.Raw{Text: "main.o"},
+		Recipe: []parser.Node{
+			&parser.RecipeLine{
+				Cmd: &parser.Expr{
+					Parts: []parser.Node{
+						&parser.Exp{Parts: []parser.Node{&parser.Raw{Text: "CC"}}},
+						&parser.Raw{Text: " -o all \\\n  main.o"},
+					},
+				},
+			},
+		},
+	}
+	n := parser.Nodes{
+		&parser.Comment{Text: "# generated"},
+		&parser.Var{
+			Base:  parser.Base{"# the compiler"},
+			Name:  &parser.Raw{Text: "CC"},
+			Op:    "=",
+			Value: "cc",
+		},
+		target,
+	}
+
+	out, err := Sprint(nil, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# generated\n# the compiler\nCC = cc\nall: main.o\n\t$(CC) -o all \\\n  main.o"
+	assert.Equal(t, expected, out)
+
+	f := parse(t, out)
+
+	out, err = Sprint(nil, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, out)
+
+	// The comments are not part of the parsed nodes, the recipe and its continuation are
+	parser.Walk(f.Nodes, func(n parser.Node) bool {
+		n.SetPos(lexer.Position{}, lexer.Position{})
+		return true
+	})
+	nodes := f.Nodes.(parser.Nodes)
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, target, nodes[1])
+}
+
+func TestFormat(t *testing.T) {
+	in := `
+A=1
+LONG_NAME   :=   2 # comment
+EMPTY =
+ifeq   ($(A),1)
+B?=3
+else    ifdef   C
+B= \
+	4
+else
+include     other.mk
+endif
+
+C=5
+
+target: dep
+	  @echo $(A)
+		echo 2
+inline: ; echo 1
+override   define   D  =
+d
+endef
+`
+	expected := `
+A         = 1
+LONG_NAME := 2 # comment
+EMPTY     =
+ifeq ($(A),1)
+B ?= 3
+else ifdef C
+B = \
+	4
+else
+include other.mk
+endif
+
+C = 5
+
+target: dep
+	@echo $(A)
+	echo 2
+inline: ; echo 1
+override define D  =
+d
+endef
+`
+
+	out, err := Format(parse(t, in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, string(out))
+
+	out, err = Format(parse(t, expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, string(out))
+}
@@ -0,0 +1,468 @@
+package runner
+
+import (
+	log "github.com/sirupsen/logrus"
+	"mxplrr/parser"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxImplicitDepth bounds the length of the chains of implicit rules
+const maxImplicitDepth = 16
+
+// PatternRule is an implicit rule, like `%.o: %.c`, whose targets and prerequisites are patterns
+type PatternRule struct {
+	Targets   []string
+	Deps      []string
+	OrderOnly []string
+	Recipe    []parser.Node
+	// Terminal is set for double-colon pattern rules, whose prerequisites must exist
+	Terminal bool
+	Node     parser.Node
+	// regexps match the Targets, they are compiled once when the rule is defined
+	regexps []*regexp.Regexp
+}
+
+func isPattern(name string) bool {
+	return strings.Contains(name, "%")
+}
+
+func (r *Runner) definePatternRule(rule *PatternRule) error {
+	log.Tracef("Defining pattern rule %v", rule.Targets)
+
+	err := rule.compile()
+	if err != nil {
+		return err
+	}
+
+	// Like make, a rule with the same targets and prerequisites replaces the previous one,
+	// and without a recipe it only cancels it
+	r.implicitRules = nil
+	r.PatternRules = withoutPatternRule(r.PatternRules, rule)
+	r.builtinPatternRules = withoutPatternRule(r.builtinPatternRules, rule)
+	if len(rule.Recipe) > 0 {
+		r.PatternRules = append(r.PatternRules, rule)
+	}
+
+	return nil
+}
+
+func (rule *PatternRule) compile() error {
+	rule.regexps = make([]*regexp.Regexp, 0, len(rule.Targets))
+	for _, pattern := range rule.Targets {
+		reg, err := toRegex(pattern)
+		if err != nil {
+			return err
+		}
+
+		rule.regexps = append(rule.regexps, reg)
+	}
+
+	return nil
+}
+
+// withoutPatternRule returns the rules that do not have the same targets and prerequisites as rule
+func withoutPatternRule(rules []*PatternRule, rule *PatternRule) []*PatternRule {
+	out := make([]*PatternRule, 0, len(rules))
+	for _, other := range rules {
+		if !samePatternRule(other, rule) {
+			out = append(out, other)
+		}
+	}
+
+	return out
+}
+
+func samePatternRule(a, b *PatternRule) bool {
+	return equalWords(a.Targets, b.Targets) && equalWords(a.Deps, b.Deps)
+}
+
+func equalWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Target returns the target name, looking for an implicit rule to supply its recipe when no explicit rule does.
+// The prerequisites of the implicit rule come first, followed by the explicit ones.
+func (r *Runner) Target(name string) (*Target, bool, error) {
+	explicit, ok := r.Targets[name]
+	if ok && (len(explicit.Recipe) > 0 || explicit.DoubleColon) {
+		return explicit, true, nil
+	}
+
+	rule, err := r.FindImplicitRule(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if rule == nil {
+		return explicit, ok, nil
+	}
+
+	t := &Target{
+		Name:      name,
+		Deps:      rule.Deps,
+		AllDeps:   rule.Deps,
+		OrderOnly: rule.OrderOnly,
+		Recipe:    rule.Recipe,
+		Rules:     []*Rule{rule},
+	}
+	if ok {
+		t.Deps = appendWords(append([]string{}, rule.Deps...), explicit.Deps...)
+		t.AllDeps = append(append([]string{}, rule.Deps...), explicit.AllDeps...)
+		t.OrderOnly = withoutWords(appendWords(append([]string{}, rule.OrderOnly...), explicit.OrderOnly...), t.Deps)
+		t.Rules = append(append([]*Rule{}, explicit.Rules...), rule)
+	}
+
+	return t, true, nil
+}
+
+// FindImplicitRule searches the pattern rules for one that can make name, returning it instantiated for name,
+// or nil if there is none. Like make, among the rules whose prerequisites exist or are mentioned in the makefiles,
+// the one with the shortest stem is chosen, and otherwise the prerequisites may themselves be made by implicit rules.
+func (r *Runner) FindImplicitRule(name string) (*Rule, error) {
+	rules, err := r.patternRules()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &implicitSearch{
+		r:         r,
+		rules:     rules,
+		mentioned: r.mentioned(),
+		inUse:     map[*PatternRule]bool{},
+	}
+
+	return s.find(name, 0)
+}
+
+// patternRules returns the pattern rules of the makefiles, followed by the built-in ones
+// and the ones converted from suffix rules, in the order make tries them
+func (r *Runner) patternRules() ([]*PatternRule, error) {
+	if r.implicitRules != nil {
+		return r.implicitRules, nil
+	}
+
+	rules := append([]*PatternRule{}, r.PatternRules...)
+	rules = append(rules, r.builtinPatternRules...)
+
+	suffixRules, err := r.suffixRules()
+	if err != nil {
+		return nil, err
+	}
+
+	// Like make, a rule converted from a suffix rule does not replace an existing one
+	for _, rule := range suffixRules {
+		if len(withoutPatternRule(rules, rule)) == len(rules) {
+			rules = append(rules, rule)
+		}
+	}
+	r.implicitRules = rules
+
+	return rules, nil
+}
+
+// mentioned returns the files that ought to exist because they are targets or explicit prerequisites in the makefiles
+func (r *Runner) mentioned() map[string]bool {
+	mentioned := map[string]bool{}
+	for name, t := range r.Targets {
+		mentioned[name] = true
+		for _, dep := range t.Deps {
+			mentioned[dep] = true
+		}
+		for _, dep := range t.OrderOnly {
+			mentioned[dep] = true
+		}
+	}
+
+	return mentioned
+}
+
+// implicitSearch is the state of the search of an implicit rule through the chains of pattern rules
+type implicitSearch struct {
+	r     *Runner
+	rules []*PatternRule
+	// mentioned are the targets and explicit prerequisites of the makefiles
+	mentioned map[string]bool
+	// inUse are the rules of the chain being tried, which can not appear twice in it
+	inUse map[*PatternRule]bool
+}
+
+// implicitMatch is a pattern rule whose target pattern matches a file name
+type implicitMatch struct {
+	rule *PatternRule
+	// dir is the directory removed from the file name before matching a target pattern without a slash
+	dir  string
+	stem string
+}
+
+func (m implicitMatch) subst(patterns []string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if isPattern(p) {
+			p = m.dir + strings.Replace(p, "%", m.stem, 1)
+		}
+		out = append(out, p)
+	}
+
+	return out
+}
+
+func (s *implicitSearch) find(name string, depth int) (*Rule, error) {
+	if depth > maxImplicitDepth {
+		return nil, nil
+	}
+
+	matches := s.matches(name, depth > 0)
+
+	// First, only consider the prerequisites which exist or ought to exist
+	for _, m := range matches {
+		ok, err := s.allDeps(m, func(dep string) (bool, error) {
+			return s.existsOrMentioned(dep), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return m.instantiate(name), nil
+		}
+	}
+
+	// Then, allow the prerequisites to be made by other implicit rules
+	for _, m := range matches {
+		if m.rule.Terminal {
+			continue
+		}
+
+		s.inUse[m.rule] = true
+		ok, err := s.allDeps(m, func(dep string) (bool, error) {
+			if s.existsOrMentioned(dep) {
+				return true, nil
+			}
+
+			rule, err := s.find(dep, depth+1)
+			return rule != nil, err
+		})
+		delete(s.inUse, m.rule)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return m.instantiate(name), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// matches returns the pattern rules matching name, from the shortest stem to the longest
+func (s *implicitSearch) matches(name string, intermediate bool) []implicitMatch {
+	dir, file := filepath.Split(name)
+
+	matches := make([]implicitMatch, 0)
+	// Like make, a file with a known suffix does not use the match-anything rules either
+	specific := s.r.suffix(name) != ""
+	for _, rule := range s.rules {
+		if s.inUse[rule] {
+			continue
+		}
+
+		for i, pattern := range rule.Targets {
+			m := implicitMatch{rule: rule}
+
+			target := name
+			if !strings.Contains(pattern, "/") {
+				target = file
+				m.dir = dir
+			}
+
+			groups := rule.regexps[i].FindStringSubmatch(target)
+			if groups == nil || groups[1] == "" {
+				continue
+			}
+			m.stem = groups[1]
+
+			if pattern != "%" {
+				specific = true
+			}
+
+			matches = append(matches, m)
+			break
+		}
+	}
+
+	// Like make, non-terminal match-anything rules only apply when no other rule matches,
+	// and never to the prerequisites of another implicit rule
+	out := make([]implicitMatch, 0, len(matches))
+	for _, m := range matches {
+		if isMatchAnything(m.rule) && !m.rule.Terminal && (specific || intermediate) {
+			continue
+		}
+		out = append(out, m)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return len(out[i].stem) < len(out[j].stem)
+	})
+
+	return out
+}
+
+func isMatchAnything(rule *PatternRule) bool {
+	for _, t := range rule.Targets {
+		if t == "%" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allDeps reports whether ok holds for all the prerequisites of m, the order-only ones included
+func (s *implicitSearch) allDeps(m implicitMatch, ok func(dep string) (bool, error)) (bool, error) {
+	deps := append(m.subst(m.rule.Deps), m.subst(m.rule.OrderOnly)...)
+	for _, dep := range deps {
+		if m.rule.Terminal {
+			if !s.r.exists(dep) {
+				return false, nil
+			}
+			continue
+		}
+
+		found, err := ok(dep)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (m implicitMatch) instantiate(name string) *Rule {
+	rule := &Rule{
+		Deps:      m.subst(m.rule.Deps),
+		OrderOnly: m.subst(m.rule.OrderOnly),
+		Recipe:    m.rule.Recipe,
+		Stem:      m.dir + m.stem,
+		Node:      m.rule.Node,
+	}
+	if len(m.rule.Targets) > 1 {
+		rule.Group = m.subst(m.rule.Targets)
+	}
+
+	return rule
+}
+
+// exists reports whether the file name exists, relative to RootDir
+func (r *Runner) exists(name string) bool {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(r.RootDir, name)
+	}
+
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// existsOrMentioned reports whether the file name exists, or ought to exist
+// because it is a target or an explicit prerequisite in the makefiles
+func (s *implicitSearch) existsOrMentioned(name string) bool {
+	return s.mentioned[name] || s.r.exists(name)
+}
+
+// defineSuffixes updates the list of known suffixes from a `.SUFFIXES` rule, which clears it when it has no prerequisites
+func (r *Runner) defineSuffixes(deps []string) {
+	r.implicitRules = nil
+	if len(deps) == 0 {
+		r.Suffixes = nil
+		return
+	}
+
+	r.Suffixes = appendWords(r.Suffixes, deps...)
+}
+
+// suffix returns the first known suffix of name, if any
+func (r *Runner) suffix(name string) string {
+	for _, suffix := range r.Suffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return suffix
+		}
+	}
+
+	return ""
+}
+
+// isSuffixRule reports whether name is the target of a suffix rule, like `.c.o` or `.c`, given the known suffixes
+func (r *Runner) isSuffixRule(name string) bool {
+	for _, source := range r.Suffixes {
+		if name == source {
+			return true
+		}
+
+		for _, target := range r.Suffixes {
+			if name == source+target {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// suffixRules converts the old-fashioned suffix rules, like `.c.o:`, to the equivalent pattern rules, like `%.o: %.c`.
+// Like make, this is done according to the known suffixes at the time of the search,
+// and the prerequisites of the suffix rules are ignored.
+func (r *Runner) suffixRules() ([]*PatternRule, error) {
+	rules := make([]*PatternRule, 0)
+	add := func(name, target, source string) error {
+		t, ok := r.Targets[name]
+		if !ok || len(t.Recipe) == 0 {
+			t, ok = r.builtinTargets[name]
+		}
+		if !ok || len(t.Recipe) == 0 {
+			return nil
+		}
+
+		rule := &PatternRule{
+			Targets: []string{"%" + target},
+			Deps:    []string{"%" + source},
+			Recipe:  t.Recipe,
+			Node:    t.Rules[len(t.Rules)-1].Node,
+		}
+		err := rule.compile()
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+		return nil
+	}
+
+	for _, source := range r.Suffixes {
+		err := add(source, "", source)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, target := range r.Suffixes {
+			err := add(source+target, target, source)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,226 @@
+package runner
+
+import (
+	"fmt"
+	"mxplrr/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Command is a line of a recipe, expanded as make would run it
+type Command struct {
+	Text string
+	// Silent is set by the `@` prefix, the command is not echoed
+	Silent bool
+	// IgnoreErrors is set by the `-` prefix, a failure of the command does not stop make
+	IgnoreErrors bool
+	// Always is set by the `+` prefix, the command runs even with `make -n`
+	Always bool
+}
+
+// ExpandRecipe returns the commands make would run to build target, looking for an implicit rule if needed.
+// The recipe is expanded with the automatic variables and the target-specific variables of target,
+// and like make, each line of the expansion of a recipe line, like a canned recipe from `define`, is a separate command.
+func (r *Runner) ExpandRecipe(target string) ([]Command, error) {
+	t, ok, err := r.Target(target)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no rule to make target '%v'", target)
+	}
+
+	vars, err := r.VarsFor(target)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]Command, 0)
+	for _, rule := range r.recipeRules(t) {
+		for k, v := range r.automaticVars(t.Name, rule) {
+			vars[k] = v
+		}
+
+		for _, n := range rule.Recipe {
+			line, ok := n.(*parser.RecipeLine)
+			if !ok {
+				return nil, fmt.Errorf("unhandled recipe line %T", n)
+			}
+
+			text, err := r.RunWithVars(vars, func() (string, error) {
+				return r.Run(line.Cmd)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, s := range splitCommands(text) {
+				cmd := parseCommand(s)
+				cmd.Silent = cmd.Silent || line.Silent
+				cmd.IgnoreErrors = cmd.IgnoreErrors || line.IgnoreErrors
+				cmd.Always = cmd.Always || line.Always
+
+				// Like make, empty commands are not run
+				if strings.TrimSpace(cmd.Text) == "" {
+					continue
+				}
+
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+
+	return cmds, nil
+}
+
+// recipeRules returns the rules whose recipes build t, each with the prerequisites it sees in $^ and $+,
+// which are all the prerequisites of the target, except for the independent double-colon rules
+func (r *Runner) recipeRules(t *Target) []*Rule {
+	if t.DoubleColon {
+		rules := make([]*Rule, 0, len(t.Rules))
+		for _, rule := range t.Rules {
+			if len(rule.Recipe) > 0 {
+				rules = append(rules, rule)
+			}
+		}
+
+		return rules
+	}
+
+	rule := &Rule{
+		Deps:      t.AllDeps,
+		OrderOnly: t.OrderOnly,
+		Recipe:    t.Recipe,
+	}
+	for _, other := range t.Rules {
+		if len(other.Recipe) > 0 {
+			rule.Stem = other.Stem
+		}
+	}
+
+	return []*Rule{rule}
+}
+
+// automaticVars returns the automatic variables of the recipe of rule building the target name
+func (r *Runner) automaticVars(name string, rule *Rule) map[string]Var {
+	deps := appendWords(make([]string, 0), rule.Deps...)
+
+	first := ""
+	if len(deps) > 0 {
+		first = deps[0]
+	}
+
+	// Like make, for an explicit rule the stem is the name without a known suffix
+	stem := rule.Stem
+	if stem == "" {
+		if suffix := r.suffix(name); suffix != "" {
+			stem = strings.TrimSuffix(name, suffix)
+		}
+	}
+
+	values := map[string][]string{
+		"@": {name},
+		"%": nil,
+		"<": {first},
+		"^": deps,
+		"+": rule.Deps,
+		"?": r.newer(name, deps),
+		"*": {stem},
+		"|": rule.OrderOnly,
+	}
+
+	vars := make(map[string]Var)
+	for k, ws := range values {
+		vars[k] = RawVar(strings.Join(ws, " "))
+		if k == "|" {
+			continue
+		}
+
+		dirs := make([]string, 0, len(ws))
+		files := make([]string, 0, len(ws))
+		for _, w := range ws {
+			if w == "" {
+				continue
+			}
+
+			dir, file := filepath.Split(w)
+			if dir == "" {
+				dir = "./"
+			}
+			dirs = append(dirs, strings.TrimSuffix(dir, "/"))
+			files = append(files, file)
+		}
+		vars[k+"D"] = RawVar(strings.Join(dirs, " "))
+		vars[k+"F"] = RawVar(strings.Join(files, " "))
+	}
+
+	return vars
+}
+
+// newer returns the prerequisites that are newer than the target name, or all of them if it does not exist.
+// Like make, the prerequisites that do not exist are considered newer, as they would be built.
+func (r *Runner) newer(name string, deps []string) []string {
+	path := func(name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(r.RootDir, name)
+	}
+
+	info, err := os.Stat(path(name))
+	if err != nil {
+		return deps
+	}
+
+	out := make([]string, 0)
+	for _, dep := range deps {
+		depInfo, err := os.Stat(path(dep))
+		if err != nil || depInfo.ModTime().After(info.ModTime()) {
+			out = append(out, dep)
+		}
+	}
+
+	return out
+}
+
+// splitCommands splits the expansion of a recipe line at the newlines that do not follow a backslash
+func splitCommands(s string) []string {
+	out := make([]string, 0)
+
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\n' || i > 0 && s[i-1] == '\\' {
+			continue
+		}
+
+		out = append(out, s[start:i])
+		start = i + 1
+	}
+
+	return append(out, s[start:])
+}
+
+// parseCommand strips the `@`, `-` and `+` prefixes of an expanded command, which like in make can be mixed with blanks
+func parseCommand(s string) Command {
+	cmd := Command{}
+
+	i := 0
+loop:
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '@':
+			cmd.Silent = true
+		case '-':
+			cmd.IgnoreErrors = true
+		case '+':
+			cmd.Always = true
+		case ' ', '\t':
+		default:
+			break loop
+		}
+	}
+	cmd.Text = s[i:]
+
+	return cmd
+}
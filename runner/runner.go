@@ -35,6 +35,29 @@ func (v ExpandVar) Value(*Runner) (string, error) {
 	return string(v), nil
 }
 
+// NodeVar is a recursively expanded variable whose value has already been parsed
+type NodeVar struct {
+	Text string
+	Node parser.Node
+}
+
+func (v NodeVar) Get(r *Runner) (string, error) {
+	return r.Run(v.Node)
+}
+
+func (v NodeVar) Value(*Runner) (string, error) {
+	return v.Text, nil
+}
+
+// varValue returns the unexpanded value assigned by n
+func varValue(n *parser.Var) Var {
+	if n.Body != nil {
+		return NodeVar{Text: n.Value, Node: n.Body}
+	}
+
+	return ExpandVar(n.Value)
+}
+
 type FuncVar func(r *Runner) (string, error)
 
 func (f FuncVar) Get(r *Runner) (string, error) {
@@ -46,7 +69,7 @@ func (f FuncVar) Value(r *Runner) (string, error) {
 }
 
 func RunExprFromString(r *Runner, s string) (string, error) {
-	p, err := parser.NewParserString(s)
+	p, err := parser.NewParserExprString(s)
 	if err != nil {
 		return "", err
 	}
@@ -66,6 +89,7 @@ func RunExprFromString(r *Runner, s string) (string, error) {
 // Used for special variables
 type Func struct {
 	parser.Base
+	parser.Span
 	Func func() (string, error)
 }
 
@@ -88,24 +112,49 @@ func New() *Runner {
 	})
 
 	return &Runner{
-		Env:     env,
-		Targets: map[string]*parser.Target{},
+		Env:        env,
+		Targets:    map[string]*Target{},
+		TargetVars: map[string][]*TargetVar{},
 	}
 }
 
 type Runner struct {
 	RootDir string
 	Env     map[string]Var
-	Targets map[string]*parser.Target
+	Targets map[string]*Target
+	// Target-specific and pattern-specific variables, by target name or pattern
+	TargetVars map[string][]*TargetVar
+	// PatternRules are the implicit rules, in definition order
+	PatternRules []*PatternRule
+	// Suffixes are the suffixes known to suffix rules, set with .SUFFIXES
+	Suffixes []string
+	// NoBuiltinRules disables the built-in implicit rules, like `make -r`
+	NoBuiltinRules bool
+	// NoBuiltinVariables disables the built-in variables, like `make -R`, along with the built-in rules
+	NoBuiltinVariables bool
 
 	files                []string
+	builtinsLoaded       bool
+	builtinTargets       map[string]*Target
+	builtinPatternRules  []*PatternRule
 	indent               string
 	reportedFailurePoint bool
+	// implicitRules caches the result of patternRules, it is reset when the targets, the pattern rules or the suffixes change
+	implicitRules []*PatternRule
 }
 
 func (r *Runner) Include(file *parser.File) error {
 	log.Tracef("%v> Include %v", r.indent, file.Path)
 
+	if !r.builtinsLoaded {
+		r.builtinsLoaded = true
+
+		err := r.loadBuiltins()
+		if err != nil {
+			return err
+		}
+	}
+
 	r.files = append(r.files, file.Path)
 	_, err := r.Run(file.Nodes)
 
@@ -156,17 +205,31 @@ func (r *Runner) Run(node parser.Node) (_ret string, _err error) {
 
 		if (left == right) == n.Expected {
 			_, err = r.RunNodes(n.Body)
+		} else {
+			_, err = r.RunNodes(n.Else)
 		}
 
 		return "", err
 	case *parser.IfDef:
 		log.Tracef("Ident: %v", n.Ident)
 
+		// Like make, a variable with an empty value is not considered defined
+		defined := false
+		if v, ok := r.Env[n.Ident]; ok {
+			value, err := v.Value(r)
+			if err != nil {
+				return "", err
+			}
+
+			defined = value != ""
+		}
+
 		var err error
-		if _, ok := r.Env[n.Ident]; ok == n.Expected {
+		if defined == n.Expected {
 			_, err = r.RunNodes(n.Body)
 		} else {
 			log.Tracef("Not found")
+			_, err = r.RunNodes(n.Else)
 		}
 
 		return "", err
@@ -200,88 +263,28 @@ func (r *Runner) Run(node parser.Node) (_ret string, _err error) {
 		}
 
 		return "", nil
+	case *parser.RecipeLine:
+		return r.Run(n.Cmd)
 	case *parser.Target:
-		name, err := r.Run(n.Name)
-		if err != nil {
-			return "", err
-		}
-
-		if name == "" {
-			return "", nil
-		}
-
-		log.Tracef("Defining target %v", name)
-
-		r.Targets[name] = n
-
-		return "", nil
+		return "", r.defineTarget(n)
+	case *parser.TargetVar:
+		return "", r.defineTargetVar(n)
 	case *parser.Var:
 		name, err := r.Run(n.Name)
 		if err != nil {
 			return "", err
 		}
 
-		switch n.Op {
-		case ":=", "::=":
-			log.Tracef("Defining simple var %v", name)
-
-			v, err := RunExprFromString(r, n.Value)
-			if err != nil {
-				return "", err
-			}
-
-			r.Env[name] = RawVar(v)
-
-			return "", nil
-		case "+=":
-			v := r.Env[name]
-
-			var currentValue string
-			if v != nil {
-				currentValue, err = v.Get(r)
-				if err != nil {
-					return "", err
-				}
-				if currentValue != "" {
-					currentValue += " "
-				}
-			}
-
-			toAppend, err := RunExprFromString(r, n.Value)
-			if err != nil {
-				return "", err
-			}
-
-			r.Env[name] = RawVar(currentValue + toAppend)
-			return "", nil
-		case "?=":
-			if _, ok := r.Env[name]; ok {
-				log.Tracef("Defining var %v", name)
-
-				value, err := RunExprFromString(r, n.Value)
-				if err != nil {
-					return "", err
-				}
-
-				r.Env[name] = RawVar(value)
-			}
-
-			return "", nil
-		case "=":
-			log.Tracef("Defining var %v", name)
-
-			r.Env[name] = ExpandVar(n.Value)
-
-			return "", nil
-		default:
-			return "", fmt.Errorf("unhandled op %s", n.Op)
-		}
+		return "", r.assign(name, n.Op, varValue(n))
 	case *parser.Define:
 		log.Tracef("Define: %v", n.Name)
 
-		r.Env[n.Name] = ExpandVar(n.Body)
+		op := n.Op
+		if op == "" {
+			op = "="
+		}
 
-		return "", nil
+		return "", r.assign(n.Name, op, ExpandVar(n.Body))
 	case *parser.PatSubst:
 		return Exps["patsubst"](r, "patsubst", []parser.Node{
 			n.Pattern,
@@ -291,13 +294,52 @@ func (r *Runner) Run(node parser.Node) (_ret string, _err error) {
 			},
 		})
 	case *parser.StaticPatternTarget:
-		// TODO: implement StaticPatternTarget
-		return "", nil
+		return "", r.defineStaticPatternTarget(n)
 	}
 
 	return "", fmt.Errorf("unhandled type %T", node)
 }
 
+// assign defines the variable name from the unexpanded value, the flavor depending on op
+func (r *Runner) assign(name, op string, value Var) error {
+	switch op {
+	case ":=", "::=":
+		log.Tracef("Defining simple var %v", name)
+
+		v, err := value.Get(r)
+		if err != nil {
+			return err
+		}
+
+		r.Env[name] = RawVar(v)
+	case "+=":
+		log.Tracef("Appending to var %v", name)
+
+		v, err := r.appendVar(r.Env[name], value)
+		if err != nil {
+			return err
+		}
+
+		r.Env[name] = v
+	case "?=":
+		if _, ok := r.Env[name]; ok {
+			return nil
+		}
+
+		log.Tracef("Defining var %v", name)
+
+		r.Env[name] = value
+	case "=":
+		log.Tracef("Defining var %v", name)
+
+		r.Env[name] = value
+	default:
+		return fmt.Errorf("unhandled op %s", op)
+	}
+
+	return nil
+}
+
 func (r *Runner) RunWithVars(args map[string]Var, f func() (string, error)) (string, error) {
 	if len(args) == 0 {
 		return f()
@@ -441,11 +483,11 @@ func (r *Runner) include(filename string) (*parser.File, error) {
 }
 
 func Words(s string) []string {
-	s = strings.TrimSpace(s)
+	words := strings.Fields(s)
 
-	if s == "" {
+	if len(words) == 0 {
 		return nil
 	}
 
-	return strings.Split(s, " ")
+	return words
 }
@@ -1,11 +1,14 @@
 package runner
 
 import (
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"mxplrr/parser"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -33,6 +36,87 @@ run:
 	return strings.TrimSuffix(string(out), "\n")
 }
 
+// makeDryRun returns the recipe make would run for target
+func makeDryRun(t *testing.T, s, target string) string {
+	return makeDryRunIn(t, "", s, target)
+}
+
+// makeDryRunIn is like makeDryRun, but runs make in dir with the extra arguments
+func makeDryRunIn(t *testing.T, dir, s, target string, args ...string) string {
+	f, err := ioutil.TempFile("", "make-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(s)
+
+	// The warnings of make are left out, only the commands are on the standard output
+	cmd := exec.Command("make", append([]string{"-n", "-f", f.Name(), target}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err, ok := err.(*exec.ExitError); ok {
+		t.Fatal(err, string(err.Stderr))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+// runRecipe expands the recipe of target, one command per line
+func runRecipe(t *testing.T, r *Runner, target string) string {
+	cmds := make([]string, 0)
+	for _, cmd := range r.Targets[target].Recipe {
+		s, err := r.Run(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmds = append(cmds, s)
+	}
+
+	return strings.Join(cmds, "\n")
+}
+
+// expandRecipe returns the commands of the recipe of target with the automatic variables expanded, one per line
+func expandRecipe(t *testing.T, r *Runner, target string) string {
+	cmds, err := r.ExpandRecipe(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		lines = append(lines, cmd.Text)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// newRunnerIn returns a runner for makefiles in a temporary directory, in which the files are created
+func newRunnerIn(t *testing.T, files ...string) *Runner {
+	d := t.TempDir()
+	for _, name := range files {
+		path := filepath.Join(d, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	r := New()
+	r.RootDir = d
+
+	return r
+}
+
 func run(t *testing.T, r *Runner, ss ...string) string {
 	var out string
 	for _, s := range ss {
@@ -325,3 +409,702 @@ bar:= $(subst $(space),$(comma),$(foo))`[1:]
 		assert.Equal(t, expected, out)
 	}
 }
+
+func TestRunner_Conditionals(t *testing.T) {
+	testCases := []struct {
+		pre string
+	}{
+		{`
+ifeq (a,b)
+R := 1
+else ifeq (a,a)
+R := 2
+else
+R := 3
+endif`},
+		{`
+ifneq (a,a)
+R := 1
+else
+R := 2
+endif`},
+		{`
+E :=
+ifdef E
+R := 1
+else ifndef E
+R := 2
+endif`},
+		{`
+E :=
+V = $(E)
+ifdef V
+R := 1
+else
+R := 2
+endif`},
+		{`
+A := x
+ifeq ($(A) ,  x)
+R := 1
+else
+R := 2
+endif`},
+		{`
+A := x
+ifeq ( $(A),x)
+R := 1
+else
+R := 2
+endif`},
+		{`
+A := x
+ifeq " $(A)" ' x'
+R := 1
+else ifneq "a,b" "a,b"
+R := 2
+else
+R := 3
+endif`},
+		{`
+A := x
+ifeq '$(A)'   "x" # comment
+R := 1
+else
+R := 2
+endif`},
+	}
+	for _, tc := range testCases {
+		out := runAsFile(t, tc.pre, "$(R)")
+		assert.NotEmpty(t, out)
+		expected := makeRun(t, tc.pre, "$(R)")
+		assert.Equal(t, expected, out, tc.pre)
+	}
+}
+
+func TestRunner_TargetVars(t *testing.T) {
+	pre := `
+X := global
+Y = y
+Z = z
+run: X += target
+r%: Y := pattern
+ru%: Y += more $(Z)
+other: Z = other`
+
+	r := &Runner{
+		RootDir: rootDir,
+		Env:     map[string]Var{},
+		files:   []string{rootDir + "/subdir/Makefile"},
+	}
+	run(t, r, pre)
+
+	vars, err := r.VarsFor("run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.RunWithVars(vars, func() (string, error) {
+		return RunExprFromString(r, "$(X) $(Y) $(Z)")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := makeRun(t, pre, "$(X) $(Y) $(Z)")
+	assert.Equal(t, expected, out)
+}
+
+func TestRunner_OrderOnly(t *testing.T) {
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, `
+DIRS := out   tmp
+a: b	c | $(DIRS) c
+`)
+
+	target := r.Targets["a"]
+	assert.Equal(t, []string{"b", "c"}, target.Deps)
+	assert.Equal(t, []string{"out", "tmp"}, target.OrderOnly)
+}
+
+func TestRunner_MultipleRules(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	pre := `
+a: x y
+a: b c
+	echo 1
+a: d | y e
+a: f
+	echo $^ "|" $|
+b c d e f x y:`
+
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, pre)
+
+	target := r.Targets["a"]
+	assert.False(t, target.DoubleColon)
+	assert.Len(t, target.Rules, 4)
+	actual := "echo " + strings.Join(target.Deps, " ") + ` "|" ` + strings.Join(target.OrderOnly, " ")
+	assert.Equal(t, makeDryRun(t, pre, "a"), actual)
+	assert.Equal(t, target.Rules[3].Recipe, target.Recipe)
+	assert.Nil(t, target.Rules[1].Recipe)
+
+	warnings := make([]string, 0)
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	assert.Equal(t, []string{
+		":6: warning: overriding recipe for target 'a'",
+		":3: warning: ignoring old recipe for target 'a'",
+	}, warnings)
+}
+
+func TestRunner_DoubleColonRules(t *testing.T) {
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, `
+a:: x
+	echo 1
+a:: y
+	echo 2
+`)
+
+	target := r.Targets["a"]
+	assert.True(t, target.DoubleColon)
+	assert.Equal(t, []string{"x", "y"}, target.Deps)
+	assert.Len(t, target.Rules, 2)
+	assert.Equal(t, []string{"x"}, target.Rules[0].Deps)
+	assert.Len(t, target.Rules[0].Recipe, 1)
+	assert.Equal(t, []string{"y"}, target.Rules[1].Deps)
+	assert.Len(t, target.Rules[1].Recipe, 1)
+
+	p, err := parser.NewParserString("a: z\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Run(n)
+	assert.EqualError(t, err, ":1: target file 'a' has both : and :: entries")
+}
+
+func TestRunner_MultipleTargets(t *testing.T) {
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, `
+NAMES := b c
+a $(NAMES): dep
+	echo $@
+x y &: gen
+	generate
+`)
+
+	for _, name := range []string{"a", "b", "c"} {
+		target := r.Targets[name]
+		assert.Equal(t, name, target.Name)
+		assert.Equal(t, []string{"dep"}, target.Deps)
+		assert.Len(t, target.Recipe, 1)
+		assert.Nil(t, target.Rules[0].Group)
+	}
+	assert.False(t, r.Targets["a"].Rules[0] == r.Targets["b"].Rules[0])
+
+	for _, name := range []string{"x", "y"} {
+		target := r.Targets[name]
+		assert.Equal(t, []string{"gen"}, target.Deps)
+		assert.Equal(t, []string{"x", "y"}, target.Rules[0].Group)
+	}
+	assert.Same(t, r.Targets["x"].Rules[0], r.Targets["y"].Rules[0])
+
+	// Overriding the recipe of one of the targets of a group does not affect the others
+	run(t, r, `
+x:
+	other
+`)
+	assert.Nil(t, r.Targets["x"].Rules[0].Recipe)
+	assert.Len(t, r.Targets["y"].Rules[0].Recipe, 1)
+	assert.Equal(t, r.Targets["y"].Recipe, r.Targets["y"].Rules[0].Recipe)
+}
+
+func TestRunner_StaticPatternRules(t *testing.T) {
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, `
+OBJS := a.o b/c.o
+$(OBJS): %.o: %.c x.h | %.d
+	cc -c $<
+foo: %.o: %.c
+`)
+
+	for name, stem := range map[string]string{"a.o": "a", "b/c.o": "b/c"} {
+		target := r.Targets[name]
+		assert.Equal(t, []string{stem + ".c", "x.h"}, target.Deps)
+		assert.Equal(t, []string{stem + ".d"}, target.OrderOnly)
+		assert.Len(t, target.Recipe, 1)
+		assert.Equal(t, stem, target.Rules[0].Stem)
+	}
+
+	// Like make, a target not matching the pattern is defined without prerequisites, its stem being its name
+	foo := r.Targets["foo"]
+	assert.Empty(t, foo.Deps)
+	assert.Equal(t, "foo", foo.Rules[0].Stem)
+
+	p, err := parser.NewParserString("a: b: c\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Run(n)
+	assert.EqualError(t, err, ":1: target pattern contains no '%'")
+}
+
+func TestRunner_ImplicitRules(t *testing.T) {
+	pre := `
+%.o: %.c | %.dir
+	generic $* $^ "|" $|
+foo%.o: foo%.c
+	specific $* $^
+%.c: %.y
+	yacc $* $^
+sub/%.x: %.c
+	sub $* $^
+%.o: %.s
+	as $*
+%.o: %.s
+%.dir:
+	mkdir $*
+gen.o: extra.h gen.y
+extra.h gen.y:
+%.out:: %.in
+	terminal $* $^
+.SECONDARY:
+`
+
+	r := newRunnerIn(t, "foobar.c", "bar.y", "d/q.c", "x.s", "t.in")
+	run(t, r, pre)
+
+	assert.NotContains(t, r.Targets, "%.o")
+
+	for _, name := range []string{
+		"foobar.o",
+		"bar.dir",
+		// bar.c is made from bar.y
+		"bar.o",
+		"bar.c",
+		"d/q.o",
+		"sub/foobar.x",
+		// gen.c can be made from gen.y, which is mentioned in the makefile
+		"gen.o",
+		"t.out",
+	} {
+		// The recipes of the prerequisites come first, and .SECONDARY keeps make from removing them afterwards
+		lines := strings.Split(makeDryRunIn(t, r.RootDir, pre, name, "-r"), "\n")
+		assert.Equal(t, lines[len(lines)-1], expandRecipe(t, r, name), name)
+	}
+
+	// The %.o: %.s rule was cancelled, and terminal rules do not chain
+	for _, name := range []string{"x.o", "u.out"} {
+		_, ok, err := r.Target(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, ok, name)
+	}
+}
+
+func TestRunner_SuffixRules(t *testing.T) {
+	pre := `
+.SUFFIXES: .c .o
+.SUFFIXES: .sh .f
+.c.o:
+	cc $* $^
+.sh:
+	cp $* $^
+.f.o: dep
+	fortran $* $^
+`
+
+	r := newRunnerIn(t, "a.c", "b.sh", "c.f")
+	run(t, r, pre)
+	assert.Equal(t, []string{".c", ".o", ".sh", ".f"}, r.Suffixes)
+
+	// Like make, the prerequisites of a suffix rule are ignored
+	for _, name := range []string{"a.o", "b", "c.o"} {
+		assert.Equal(t, makeDryRunIn(t, r.RootDir, pre, name, "-r"), expandRecipe(t, r, name), name)
+	}
+
+	// Suffix rules are converted according to the suffixes and the recipes known at the time of the search
+	post := `
+.SUFFIXES:
+.SUFFIXES: .sh
+`
+	run(t, r, post)
+	assert.Equal(t, []string{".sh"}, r.Suffixes)
+
+	_, ok, err := r.Target("a.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, ok)
+
+	assert.Equal(t, makeDryRunIn(t, r.RootDir, pre+post, "b", "-r"), expandRecipe(t, r, "b"))
+
+	override := `
+.sh:
+	ln $* $^
+`
+	run(t, r, override)
+	assert.Equal(t, makeDryRunIn(t, r.RootDir, pre+post+override, "b", "-r"), expandRecipe(t, r, "b"))
+}
+
+func TestRunner_Builtins(t *testing.T) {
+	include := func(r *Runner, s string) {
+		f, err := parser.ParseSource(r.RootDir+"/Makefile", []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Include(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := func(r *Runner, name string) bool {
+		_, ok, err := r.Target(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ok
+	}
+
+	expr := "$(CC)|$(COMPILE.c)|$(RM)|$(SUFFIXES)"
+	pre := "CFLAGS = -O2"
+
+	r := newRunnerIn(t, "prog.c")
+	include(r, pre)
+	assert.Equal(t, makeRun(t, pre, "'"+expr+"'"), run(t, r, expr))
+	for _, name := range []string{"prog.o", "prog"} {
+		assert.Equal(t, makeDryRunIn(t, r.RootDir, pre, name), expandRecipe(t, r, name), name)
+	}
+	assert.Empty(t, r.Targets)
+
+	// Clearing the suffixes disables the built-in suffix rules
+	r = newRunnerIn(t, "prog.c")
+	include(r, ".SUFFIXES:")
+	assert.False(t, found(r, "prog.o"))
+
+	r = newRunnerIn(t, "prog.c")
+	r.NoBuiltinRules = true
+	include(r, "")
+	assert.False(t, found(r, "prog.o"))
+	assert.Equal(t, "cc", run(t, r, "$(CC)"))
+
+	r = newRunnerIn(t, "prog.c")
+	r.NoBuiltinVariables = true
+	include(r, "")
+	assert.False(t, found(r, "prog.o"))
+	assert.Equal(t, "", run(t, r, "$(CC)"))
+}
+
+func TestRunner_ExpandRecipe(t *testing.T) {
+	s := `
+CFLAGS = -O2
+OBJS := out/a.o b.o
+define LINK
+@echo linking $@
+$(CC) -o $@ $^
+endef
+prog: $(OBJS) lib.a lib.a | out
+	$(LINK)
+	@echo '$+ / $| / $(^F) / $(@D) / $(?D)'
+	+echo a \
+	  b
+$(OBJS): %.o: %.c x.h
+	-$(CC) $(CFLAGS) -c $< -o $@ $* $(*F) $(<D)
+%.s: %.c
+	cc -S $< -o $@ $*
+sub/baz.c: %.o: %.c
+	echo $* $(*F) $(*D)
+multi: x y x
+multi: y z
+	echo 1
+multi: z w | x q
+multi: v
+	echo $+ / $^ / $|
+out/a.c b.c c.c x.h lib.a out v w x y z q:
+prog: CC = gcc
+`
+
+	p, err := parser.NewParserString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.RootDir = "."
+	err = r.Include(&parser.File{Path: "Makefile", Nodes: n})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"out/a.o", "b.o", "c.s", "c.o", "sub/baz.c", "multi"} {
+		assert.Equal(t, makeDryRun(t, s, target), expandRecipe(t, r, target), target)
+	}
+
+	cmds, err := r.ExpandRecipe("prog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Command{
+		{Text: "echo linking prog", Silent: true},
+		{Text: "gcc -o prog out/a.o b.o lib.a"},
+		{Text: "echo 'out/a.o b.o lib.a lib.a / out / a.o b.o lib.a / . / out . .'", Silent: true},
+		{Text: "echo a \\\n  b", Always: true},
+	}, cmds)
+
+	cmds, err = r.ExpandRecipe("b.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, cmds[0].IgnoreErrors)
+}
+
+func TestRunner_Define(t *testing.T) {
+	testCases := []struct {
+		pre string
+	}{
+		{`
+A := 1
+define R
+$(A)
+endef
+A := 2`},
+		{`
+A := 1
+define R :=
+$(A)
+endef
+A := 2`},
+		{`
+A := 1
+R = a $(A)
+define R +=
+b $(A)
+endef
+A := 2`},
+		{`
+R := 1
+override define R ?=
+2
+endef`},
+		{`
+define TEMPLATE
+define $(1)_R
+$(1) done
+endef
+endef
+$(eval $(call TEMPLATE,x))
+R := $(x_R)`},
+		{`
+R := 1
+R ?= 2`},
+		{`
+R ?= 2`},
+	}
+	for _, tc := range testCases {
+		out := runAsFile(t, tc.pre, "$(R)")
+		assert.NotEmpty(t, out)
+		expected := makeRun(t, tc.pre, "$(R)")
+		assert.Equal(t, expected, out, tc.pre)
+	}
+}
+
+func TestRunner_VarBody(t *testing.T) {
+	pre := `
+A = 1
+B := $(A) a
+C = $(A) c
+C += $(B)
+D ?= $(C)
+A = 2
+R := $(B) $(C) $(D)`
+
+	p, err := parser.NewParserString(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ParseVarBody = true
+
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Runner{
+		RootDir: rootDir,
+		Env:     map[string]Var{},
+		files:   []string{rootDir + "/subdir/Makefile"},
+	}
+	if _, err := r.Run(n); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.IsType(t, NodeVar{}, r.Env["C"])
+	value, err := r.Env["C"].Value(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "$(A) c $(B)", value)
+
+	out := run(t, r, "$(R)")
+	expected := makeRun(t, pre, "$(R)")
+	assert.Equal(t, expected, out)
+}
+
+func TestRunner_Escapes(t *testing.T) {
+	testCases := []struct {
+		pre string
+	}{
+		{`R = a$$b`},
+		{`R := a$$b`},
+		{`
+A := $$x
+R = $(A)`},
+		{`R = a\#b # comment`},
+		{`R := $(subst x,$$,axb)`},
+		{`R := $(shell echo '$$x')`},
+		{`
+A = 1
+$(eval B = $$A)
+A = 2
+R := $(B)`},
+	}
+	for _, tc := range testCases {
+		r := &Runner{
+			Env: map[string]Var{},
+		}
+		out := run(t, r, tc.pre, "$(R)")
+		assert.NotEmpty(t, out)
+		// Quoted, so that the shell leaves the dollars alone
+		expected := makeRun(t, tc.pre, "'$(R)'")
+		assert.Equal(t, expected, out, tc.pre)
+	}
+}
+
+func TestRunner_RecipeEscapes(t *testing.T) {
+	pre := `
+X := $$y
+a:
+	echo \# $$x $(X) # not a comment
+	echo '$$(X)'`
+
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, pre)
+
+	assert.Equal(t, makeDryRun(t, pre, "a"), runRecipe(t, r, "a"))
+}
+
+func TestRunner_Continuations(t *testing.T) {
+	testCases := []struct {
+		pre string
+	}{
+		{`R = a   \
+    b`},
+		{`R := a \
+  \
+  $(firstword b \
+  c)`},
+		{`R =   \
+  a`},
+		{`
+define R
+a \
+   b
+endef`},
+		{`
+.POSIX:
+X = x
+R = a \
+ \
+ b   \
+c`},
+	}
+	for _, tc := range testCases {
+		r := &Runner{
+			Env: map[string]Var{},
+		}
+		out := run(t, r, tc.pre, "$(R)")
+		assert.NotEmpty(t, out)
+		expected := makeRun(t, tc.pre, "'$(R)'")
+		assert.Equal(t, expected, out, tc.pre)
+	}
+
+	pre := `
+a: b \
+   c
+	echo "a \
+	  b" \
+	$(firstword x \
+	y)
+b c:`
+
+	r := &Runner{
+		Env: map[string]Var{},
+	}
+	run(t, r, pre)
+
+	assert.Equal(t, makeDryRun(t, pre, "a"), runRecipe(t, r, "a"))
+	assert.Equal(t, []string{"b", "c"}, r.Targets["a"].Deps)
+}
+
+func TestRunner_Parens(t *testing.T) {
+	testCases := []struct {
+		pre string
+	}{
+		{`R := $(shell echo $$(echo hi))`},
+		{`R := ${subst {a},[a],x{a}y}`},
+		{`R := $(subst {,[,a{b)`},
+		{`
+x := a(b)c
+R := ${x}`},
+		{`R := $(patsubst %,(%),a b)`},
+		{`R := $(subst (a,b),c,x(a,b)y)`},
+		{`
+A = 1
+$(eval B = $$(A))
+A = 2
+R := $(B)`},
+	}
+	for _, tc := range testCases {
+		r := &Runner{
+			Env: map[string]Var{},
+		}
+		out := run(t, r, tc.pre, "$(R)")
+		assert.NotEmpty(t, out)
+		expected := makeRun(t, tc.pre, "'$(R)'")
+		assert.Equal(t, expected, out, tc.pre)
+	}
+}
@@ -0,0 +1,295 @@
+package runner
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mxplrr/parser"
+	"strings"
+)
+
+// Target is a target along with the rules defining it, whose names and prerequisites have been evaluated
+type Target struct {
+	Name string
+	// Prerequisites merged from all the rules, the ones of the rules supplying a recipe first
+	Deps []string
+	// AllDeps are the prerequisites in the same order as Deps, keeping the duplicates for $+
+	AllDeps   []string
+	OrderOnly []string
+	// Recipe of the last rule supplying one
+	Recipe      []parser.Node
+	DoubleColon bool
+	Rules       []*Rule
+}
+
+// Rule is a single rule of a target.
+// Double-colon rules are independent, each one having its own prerequisites and recipe.
+type Rule struct {
+	// Group lists the targets produced together by the recipe of a grouped rule
+	Group     []string
+	Deps      []string
+	OrderOnly []string
+	Recipe    []parser.Node
+	// Stem is the part of the target matched by the % of a static pattern rule or of an implicit rule
+	Stem string
+	Node parser.Node
+}
+
+func (r *Runner) words(n parser.Node) ([]string, error) {
+	if n == nil {
+		return nil, nil
+	}
+
+	s, err := r.Run(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return Words(s), nil
+}
+
+func (r *Runner) defineTarget(n *parser.Target) error {
+	names, err := r.words(n.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	deps, err := r.words(n.Deps)
+	if err != nil {
+		return err
+	}
+
+	orderOnly, err := r.words(n.OrderOnly)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 1 && names[0] == ".SUFFIXES" {
+		r.defineSuffixes(deps)
+	}
+	if len(names) == 1 && len(deps) > 0 && r.isSuffixRule(names[0]) {
+		log.Warnf("%v: warning: ignoring prerequisites on suffix rule definition", location(n))
+	}
+
+	patterns := 0
+	for _, name := range names {
+		if isPattern(name) {
+			patterns++
+		}
+	}
+	switch {
+	case patterns == len(names):
+		return r.definePatternRule(&PatternRule{
+			Targets:   names,
+			Deps:      deps,
+			OrderOnly: orderOnly,
+			Recipe:    n.Recipe,
+			Terminal:  n.DoubleColon,
+			Node:      n,
+		})
+	case patterns > 0:
+		// Like make, the rule is then defined as a normal one
+		log.Warnf("%v: *** mixed implicit and normal rules: deprecated syntax", location(n))
+	}
+
+	var group *Rule
+	if n.Grouped {
+		// A single rule is shared by all the targets of the group
+		group = &Rule{
+			Group:     names,
+			Deps:      deps,
+			OrderOnly: orderOnly,
+			Recipe:    n.Recipe,
+			Node:      n,
+		}
+	}
+
+	for _, name := range names {
+		log.Tracef("Defining target %v", name)
+
+		rule := group
+		if rule == nil {
+			rule = &Rule{
+				Deps:      deps,
+				OrderOnly: orderOnly,
+				Recipe:    n.Recipe,
+				Node:      n,
+			}
+		}
+
+		err := r.addRule(name, n.DoubleColon, rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Runner) defineStaticPatternTarget(n *parser.StaticPatternTarget) error {
+	names, err := r.words(n.Names)
+	if err != nil {
+		return err
+	}
+
+	pattern, err := r.Run(n.Targets)
+	if err != nil {
+		return err
+	}
+	pattern = strings.TrimSpace(pattern)
+
+	if !strings.Contains(pattern, "%") {
+		return fmt.Errorf("%v: target pattern contains no '%%'", location(n))
+	}
+
+	reg, err := toRegex(pattern)
+	if err != nil {
+		return err
+	}
+
+	prereqs, err := r.words(n.Prereqs)
+	if err != nil {
+		return err
+	}
+
+	orderOnly, err := r.words(n.OrderOnly)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		log.Tracef("Defining target %v from pattern %v", name, pattern)
+
+		rule := &Rule{
+			Recipe: n.Recipe,
+			Node:   n,
+		}
+
+		groups := reg.FindStringSubmatch(name)
+		if groups == nil {
+			// Like make, the target is still defined, without prerequisites, and its name is the stem
+			log.Errorf("%v: target '%v' doesn't match the target pattern", location(n), name)
+			rule.Stem = name
+		} else {
+			rule.Stem = groups[1]
+			rule.Deps = substStem(prereqs, rule.Stem)
+			rule.OrderOnly = substStem(orderOnly, rule.Stem)
+		}
+
+		err := r.addRule(name, false, rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// substStem replaces the first % of each of the patterns with stem
+func substStem(patterns []string, stem string) []string {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		out = append(out, strings.Replace(p, "%", stem, 1))
+	}
+
+	return out
+}
+
+func (r *Runner) addRule(name string, doubleColon bool, rule *Rule) error {
+	if r.Targets == nil {
+		r.Targets = map[string]*Target{}
+	}
+	// The recipe of a suffix rule may change
+	r.implicitRules = nil
+
+	t, ok := r.Targets[name]
+	if !ok {
+		t = &Target{
+			Name:        name,
+			DoubleColon: doubleColon,
+		}
+		r.Targets[name] = t
+	}
+
+	if t.DoubleColon != doubleColon {
+		return fmt.Errorf("%v: target file '%v' has both : and :: entries", location(rule.Node), name)
+	}
+
+	if len(rule.Recipe) > 0 && !doubleColon {
+		for i, previous := range t.Rules {
+			if len(previous.Recipe) > 0 {
+				log.Warnf("%v: warning: overriding recipe for target '%v'", location(rule.Node), name)
+				log.Warnf("%v: warning: ignoring old recipe for target '%v'", location(previous.Node), name)
+
+				// The rule may be shared with the other targets of a group, which keep the recipe
+				overridden := *previous
+				overridden.Recipe = nil
+				t.Rules[i] = &overridden
+			}
+		}
+
+		t.Recipe = rule.Recipe
+	}
+
+	t.Rules = append(t.Rules, rule)
+
+	// Like make, the prerequisites of a rule with a recipe are put before the ones already known, the others after
+	if len(rule.Recipe) > 0 && !doubleColon {
+		t.AllDeps = append(append(make([]string, 0), rule.Deps...), t.AllDeps...)
+		t.OrderOnly = appendWords(appendWords(make([]string, 0), rule.OrderOnly...), t.OrderOnly...)
+	} else {
+		t.AllDeps = append(t.AllDeps, rule.Deps...)
+		t.OrderOnly = appendWords(t.OrderOnly, rule.OrderOnly...)
+	}
+	t.Deps = appendWords(make([]string, 0), t.AllDeps...)
+	t.OrderOnly = withoutWords(t.OrderOnly, t.Deps)
+
+	return nil
+}
+
+// location formats the position of n like make does in its messages
+func location(n parser.Node) string {
+	if n == nil {
+		return "<unknown>"
+	}
+
+	pos := n.Pos().Start
+	return fmt.Sprintf("%v:%v", pos.Filename, pos.Line)
+}
+
+// appendWords appends the words of ws that are not in dst yet
+func appendWords(dst []string, ws ...string) []string {
+	for _, w := range ws {
+		if !containsWord(dst, w) {
+			dst = append(dst, w)
+		}
+	}
+
+	return dst
+}
+
+func containsWord(ws []string, w string) bool {
+	for _, e := range ws {
+		if w == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutWords returns the words of ws that are not in exclude.
+// Like make, a prerequisite that is both normal and order-only is considered normal.
+func withoutWords(ws []string, exclude []string) []string {
+	out := make([]string, 0, len(ws))
+	for _, w := range ws {
+		if !containsWord(exclude, w) {
+			out = append(out, w)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,185 @@
+package runner
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mxplrr/parser"
+	"sort"
+	"strings"
+)
+
+// TargetVar is a variable assignment scoped to a target or a pattern
+type TargetVar struct {
+	Name     string
+	Op       string
+	Value    Var
+	Override bool
+	Export   bool
+	Private  bool
+}
+
+func (r *Runner) defineTargetVar(n *parser.TargetVar) error {
+	targets, err := r.Run(n.Targets)
+	if err != nil {
+		return err
+	}
+
+	name, err := r.Run(n.Var.Name)
+	if err != nil {
+		return err
+	}
+
+	value := varValue(n.Var)
+	switch n.Var.Op {
+	case ":=", "::=":
+		v, err := value.Get(r)
+		if err != nil {
+			return err
+		}
+
+		value = RawVar(v)
+	case "=", "+=", "?=":
+	default:
+		return fmt.Errorf("unhandled op %s", n.Var.Op)
+	}
+
+	if r.TargetVars == nil {
+		r.TargetVars = map[string][]*TargetVar{}
+	}
+
+	for _, target := range Words(targets) {
+		log.Tracef("Defining var %v for %v", name, target)
+
+		r.TargetVars[target] = append(r.TargetVars[target], &TargetVar{
+			Name:     name,
+			Op:       n.Var.Op,
+			Value:    value,
+			Override: n.Override,
+			Export:   n.Export,
+			Private:  n.Private,
+		})
+	}
+
+	return nil
+}
+
+// VarsFor returns the target-specific and pattern-specific variables that apply to target.
+// Pattern-specific variables are applied first, from the longest stem to the shortest,
+// then the target-specific ones; the values inherited from the targets depending on target are not included.
+// The result is meant to be used with RunWithVars.
+func (r *Runner) VarsFor(target string) (map[string]Var, error) {
+	type match struct {
+		stem int
+		vars []*TargetVar
+	}
+
+	matches := make([]match, 0)
+	for pattern, vars := range r.TargetVars {
+		if !strings.Contains(pattern, "%") {
+			continue
+		}
+
+		reg, err := toRegex(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		groups := reg.FindStringSubmatch(target)
+		if groups == nil {
+			continue
+		}
+
+		matches = append(matches, match{stem: len(groups[1]), vars: vars})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].stem > matches[j].stem
+	})
+
+	if vars, ok := r.TargetVars[target]; ok {
+		matches = append(matches, match{vars: vars})
+	}
+
+	env := make(map[string]Var)
+	lookup := func(name string) Var {
+		if v, ok := env[name]; ok {
+			return v
+		}
+
+		return r.Env[name]
+	}
+
+	for _, m := range matches {
+		for _, tv := range m.vars {
+			switch tv.Op {
+			case "?=":
+				if lookup(tv.Name) == nil {
+					env[tv.Name] = tv.Value
+				}
+			case "+=":
+				v, err := r.appendVar(lookup(tv.Name), tv.Value)
+				if err != nil {
+					return nil, err
+				}
+
+				env[tv.Name] = v
+			default:
+				env[tv.Name] = tv.Value
+			}
+		}
+	}
+
+	return env, nil
+}
+
+// appendVar appends value to current, keeping the flavor of current
+func (r *Runner) appendVar(current Var, value Var) (Var, error) {
+	if current == nil {
+		return value, nil
+	}
+
+	if cv, ok := current.(NodeVar); ok {
+		if cv.Text == "" {
+			return value, nil
+		}
+
+		if v, ok := value.(NodeVar); ok {
+			return NodeVar{
+				Text: cv.Text + " " + v.Text,
+				Node: &parser.Expr{
+					Parts: []parser.Node{cv.Node, &parser.Raw{Text: " "}, v.Node},
+				},
+			}, nil
+		}
+
+		current = ExpandVar(cv.Text)
+	}
+
+	if cv, ok := current.(ExpandVar); ok {
+		text, err := value.Value(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if cv == "" {
+			return ExpandVar(text), nil
+		}
+
+		return ExpandVar(string(cv) + " " + text), nil
+	}
+
+	currentValue, err := current.Get(r)
+	if err != nil {
+		return nil, err
+	}
+
+	toAppend, err := value.Get(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if currentValue == "" {
+		return RawVar(toAppend), nil
+	}
+
+	return RawVar(currentValue + " " + toAppend), nil
+}